@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"loadbalancer/balancer"
+	"loadbalancer/config"
+	"loadbalancer/router"
+)
+
+// newAdminHandler serves the admin API: pool and mirroring metrics, the
+// weights and metrics of split routes, whose weights can be changed with
+//
+//	PUT /splits/{route} {"stable": 95, "canary": 5}
+//
+// and canary rollouts, started with POST /rollouts/{route} and a rollout
+// configuration, and aborted with DELETE. With a token, every request must
+// carry it as "Authorization: Bearer <token>".
+func newAdminHandler(rt *router.Router, token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		metrics := make(map[string]*balancer.Metrics)
+		for name, lb := range rt.Pools() {
+			metrics[name] = lb.GetMetrics()
+		}
+		json.NewEncoder(w).Encode(metrics)
+	})
+
+	mux.HandleFunc("GET /splits", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(rt.AllSplits())
+	})
+
+	mux.HandleFunc("GET /splits/{route}", func(w http.ResponseWriter, r *http.Request) {
+		splits, err := rt.Splits(r.PathValue("route"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(splits)
+	})
+
+	mux.HandleFunc("PUT /splits/{route}", func(w http.ResponseWriter, r *http.Request) {
+		var weights map[string]int
+		if err := json.NewDecoder(r.Body).Decode(&weights); err != nil {
+			http.Error(w, "Invalid weights: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		route := r.PathValue("route")
+		if err := rt.SetWeights(route, weights); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		splits, _ := rt.Splits(route)
+		json.NewEncoder(w).Encode(splits)
+	})
+
+	mux.HandleFunc("GET /mirrors", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(rt.Mirrors())
+	})
+
+	mux.HandleFunc("GET /rollouts", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(rt.Rollouts())
+	})
+
+	mux.HandleFunc("POST /rollouts/{route}", func(w http.ResponseWriter, r *http.Request) {
+		var cfg config.RolloutConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "Invalid rollout: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		route := r.PathValue("route")
+		if err := rt.StartRollout(rollout(route, cfg)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(rt.Rollouts()[route])
+	})
+
+	mux.HandleFunc("DELETE /rollouts/{route}", func(w http.ResponseWriter, r *http.Request) {
+		route := r.PathValue("route")
+		if err := rt.AbortRollout(route); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(rt.Rollouts()[route])
+	})
+
+	if token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
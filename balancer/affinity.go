@@ -0,0 +1,276 @@
+package balancer
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sv "loadbalancer/server"
+)
+
+// Affinity modes.
+const (
+	AffinityNone   = ""
+	AffinityCookie = "cookie"      // the balancer issues a cookie naming the server
+	AffinityLearn  = "application" // the balancer learns which server set the application's cookie
+)
+
+// AffinityPolicy pins a client to the server that first served it, while
+// that server stays healthy.
+type AffinityPolicy struct {
+	Mode string
+
+	// Cookie is the template of the cookie issued in AffinityCookie mode:
+	// its name, path, domain and attributes. MaxAge bounds how long a client
+	// stays pinned; zero makes it a session cookie with no expiry. In
+	// AffinityLearn mode only its name is used, naming the application's
+	// session cookie.
+	Cookie http.Cookie
+
+	// Secret signs cookie values so clients cannot pick a server
+	// themselves. Balancers sharing clients must share the secret; when
+	// empty, a random one is used and cookies are not valid across restarts.
+	Secret []byte
+
+	// TableSize bounds the number of cookie values remembered in
+	// AffinityLearn mode; the least recently used are forgotten first.
+	TableSize int
+
+	// TableTTL is how long an unused cookie value is remembered in
+	// AffinityLearn mode.
+	TableTTL time.Duration
+}
+
+// DefaultAffinityPolicy returns the affinity settings used when none are
+// configured. Affinity is off.
+func DefaultAffinityPolicy() AffinityPolicy {
+	return AffinityPolicy{
+		Cookie: http.Cookie{
+			Name:     "lb_affinity",
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		TableSize: 10000,
+		TableTTL:  time.Hour,
+	}
+}
+
+// affinityKey returns the secret cookies are signed with.
+func (lb *LoadBalancer) affinityKey() []byte {
+	lb.affinityKeyOnce.Do(func() {
+		lb.affinitySecret = lb.AffinityPolicy.Secret
+		if len(lb.affinitySecret) == 0 {
+			lb.affinitySecret = make([]byte, 32)
+			rand.Read(lb.affinitySecret)
+		}
+	})
+	return lb.affinitySecret
+}
+
+// pinnedServer returns the healthy server r's affinity cookie pins it to, or
+// nil if there is none.
+func (lb *LoadBalancer) pinnedServer(r *http.Request) *sv.Server {
+	if lb.AffinityPolicy.Mode == AffinityNone {
+		return nil
+	}
+	c, err := r.Cookie(lb.AffinityPolicy.Cookie.Name)
+	if err != nil {
+		return nil
+	}
+
+	var id string
+	var ok bool
+	switch lb.AffinityPolicy.Mode {
+	case AffinityCookie:
+		id, ok = lb.verifyAffinity(c.Value, time.Now())
+	case AffinityLearn:
+		atomic.AddUint64(&lb.metrics.AffinityLookups, 1)
+		id, ok = lb.affinityTable.get(c.Value, lb.AffinityPolicy.TableTTL, time.Now())
+	}
+	if !ok {
+		return nil
+	}
+	server := lb.serverByID(id)
+	if server != nil && lb.AffinityPolicy.Mode == AffinityLearn {
+		atomic.AddUint64(&lb.metrics.AffinityHits, 1)
+	}
+	return server
+}
+
+// serverByID returns the healthy server with the given ID, or nil if there
+// is none.
+func (lb *LoadBalancer) serverByID(id string) *sv.Server {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	for _, server := range lb.Servers {
+		if serverID(server) == id {
+			if !lb.draining[server] && server.IsHealthy() {
+				return server
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// pin makes the response pin the client to server, unless it already is. In
+// AffinityLearn mode it remembers the server for the session cookie resp
+// sets instead, and forgets the session when resp deletes the cookie.
+func (lb *LoadBalancer) pin(w http.ResponseWriter, r *http.Request, resp *http.Response, pinned, server *sv.Server) {
+	if lb.AffinityPolicy.Mode == AffinityLearn {
+		now := time.Now()
+		for _, c := range resp.Cookies() {
+			if c.Name != lb.AffinityPolicy.Cookie.Name {
+				continue
+			}
+			if c.MaxAge < 0 || (c.MaxAge == 0 && !c.Expires.IsZero() && !c.Expires.After(now)) {
+				// Deleting cookies often carry no value, so the client's
+				// one names the session
+				if old, err := r.Cookie(c.Name); err == nil {
+					lb.affinityTable.remove(old.Value)
+				}
+				lb.affinityTable.remove(c.Value)
+			} else if c.Value != "" {
+				lb.affinityTable.put(c.Value, serverID(server), lb.AffinityPolicy.TableSize, now)
+			}
+		}
+		return
+	}
+	if lb.AffinityPolicy.Mode != AffinityCookie || server == pinned {
+		return
+	}
+	c := lb.AffinityPolicy.Cookie
+	var expires int64
+	if c.MaxAge > 0 {
+		expires = time.Now().Add(time.Duration(c.MaxAge) * time.Second).Unix()
+	}
+	c.Value = lb.signAffinity(serverID(server), expires)
+	http.SetCookie(w, &c)
+}
+
+// serverID identifies server in cookies without revealing its URL.
+func serverID(server *sv.Server) string {
+	sum := sha256.Sum256([]byte(server.URL))
+	return hex.EncodeToString(sum[:8])
+}
+
+// signAffinity returns the cookie value "<id>.<expires>.<signature>".
+// expires is a Unix time, or 0 for none.
+func (lb *LoadBalancer) signAffinity(id string, expires int64) string {
+	payload := id + "." + strconv.FormatInt(expires, 10)
+	return payload + "." + lb.affinitySignature(payload)
+}
+
+// verifyAffinity returns the server ID in a cookie value, if the value was
+// signed by this balancer and has not expired by now.
+func (lb *LoadBalancer) verifyAffinity(value string, now time.Time) (string, bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", false
+	}
+	payload, sig := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(lb.affinitySignature(payload))) {
+		return "", false
+	}
+	id, exp, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || (expires != 0 && now.Unix() >= expires) {
+		return "", false
+	}
+	return id, true
+}
+
+func (lb *LoadBalancer) affinitySignature(payload string) string {
+	mac := hmac.New(sha256.New, lb.affinityKey())
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// affinityTable remembers which server issued each session cookie value,
+// bounded in size and in how long an unused value is kept. The zero value is
+// an empty table.
+type affinityTable struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // of *affinityEntry, least recently used first
+}
+
+type affinityEntry struct {
+	value    string
+	serverID string
+	used     time.Time
+}
+
+// get returns the server ID remembered for value, unless it went unused for
+// longer than ttl.
+func (t *affinityTable) get(value string, ttl time.Duration, now time.Time) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	el, ok := t.entries[value]
+	if !ok {
+		return "", false
+	}
+	entry := el.Value.(*affinityEntry)
+	if ttl > 0 && now.Sub(entry.used) > ttl {
+		t.lru.Remove(el)
+		delete(t.entries, value)
+		return "", false
+	}
+	entry.used = now
+	t.lru.MoveToBack(el)
+	return entry.serverID, true
+}
+
+// put remembers that value belongs to serverID, forgetting the least
+// recently used values beyond size.
+func (t *affinityTable) put(value, serverID string, size int, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.entries == nil {
+		t.entries = make(map[string]*list.Element)
+	}
+	if el, ok := t.entries[value]; ok {
+		entry := el.Value.(*affinityEntry)
+		entry.serverID = serverID
+		entry.used = now
+		t.lru.MoveToBack(el)
+		return
+	}
+	t.entries[value] = t.lru.PushBack(&affinityEntry{value: value, serverID: serverID, used: now})
+	for size > 0 && t.lru.Len() > size {
+		oldest := t.lru.Front()
+		t.lru.Remove(oldest)
+		delete(t.entries, oldest.Value.(*affinityEntry).value)
+	}
+}
+
+// remove forgets value.
+func (t *affinityTable) remove(value string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if el, ok := t.entries[value]; ok {
+		t.lru.Remove(el)
+		delete(t.entries, value)
+	}
+}
+
+func (t *affinityTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lru.Len()
+}
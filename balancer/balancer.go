@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,22 +15,47 @@ import (
 	"loadbalancer/utils"
 )
 
+// defaultDrainTimeout bounds how long a server being removed, or a balancer
+// shutting down, waits for requests and connections to finish.
+const defaultDrainTimeout = 30 * time.Second
+
 type LoadBalancer struct {
+	Name            string
 	Servers         []*sv.Server
+	ServerOptions   sv.Options
+	RetryPolicy     RetryPolicy
+	HedgePolicy     HedgePolicy
+	AffinityPolicy  AffinityPolicy
+	UDPPolicy       UDPPolicy
+	DrainTimeout    time.Duration // how long RemoveServer and GracefulShutdown wait before closing connections
 	mu              sync.RWMutex
 	Logger          *log.Logger
 	wg              sync.WaitGroup
 	shutdown        bool
 	metrics         *Metrics
-	maxRetries      int
+	retryBudget     budget
+	hedgeBudget     budget
 	strategy        string
 	roundRobinIndex int64
+	affinityKeyOnce sync.Once
+	affinitySecret  []byte
+	affinityTable   affinityTable
+	draining        map[*sv.Server]bool
 }
 
 type Metrics struct {
-	TotalRequests     uint64
-	FailedRequests    uint64
-	ActiveConnections int64
+	TotalRequests        uint64
+	FailedRequests       uint64
+	ActiveConnections    int64
+	Retries              uint64
+	RetryBudgetExhausted uint64
+	Hedges               uint64
+	HedgeWins            uint64
+	HedgeWinRate         float64 // share of hedges that answered first
+	AffinityEntries      int     // session cookie values remembered in application affinity mode
+	AffinityLookups      uint64
+	AffinityHits         uint64
+	AffinityHitRate      float64 // share of lookups that found a healthy server
 }
 
 func NewLoadBalancer(logger *log.Logger, strategy string) *LoadBalancer {
@@ -42,7 +68,12 @@ func NewLoadBalancer(logger *log.Logger, strategy string) *LoadBalancer {
 	return &LoadBalancer{
 		Logger:          logger,
 		metrics:         &Metrics{},
-		maxRetries:      3,
+		ServerOptions:   sv.DefaultOptions(),
+		RetryPolicy:     DefaultRetryPolicy(),
+		HedgePolicy:     DefaultHedgePolicy(),
+		AffinityPolicy:  DefaultAffinityPolicy(),
+		UDPPolicy:       DefaultUDPPolicy(),
+		DrainTimeout:    defaultDrainTimeout,
 		strategy:        strategy,
 		roundRobinIndex: -1,
 	}
@@ -56,6 +87,9 @@ func (lb *LoadBalancer) AddServer(url string) error {
 	if url == "" {
 		return errors.New("server URL cannot be empty")
 	}
+	if err := sv.ValidateURL(url); err != nil {
+		return err
+	}
 
 	// Check for duplicate servers
 	for _, server := range lb.Servers {
@@ -65,6 +99,7 @@ func (lb *LoadBalancer) AddServer(url string) error {
 	}
 
 	server := sv.NewServer(url, lb.Logger)
+	server.Options = lb.ServerOptions
 	lb.Servers = append(lb.Servers, server)
 	lb.Logger.Println(utils.Colorize("Added server "+url+" to the load balancer", utils.GREEN))
 	return nil
@@ -76,14 +111,30 @@ func (lb *LoadBalancer) RemoveServer(url string) error {
 
 	for i, server := range lb.Servers {
 		if server.URL == url {
-			// Wait for active connections to finish
-			for server.Load > 0 {
+			// Send no new requests or connections its way, and wait for the
+			// active ones to finish
+			if lb.draining == nil {
+				lb.draining = make(map[*sv.Server]bool)
+			}
+			lb.draining[server] = true
+			defer delete(lb.draining, server)
+			deadline := time.Now().Add(lb.DrainTimeout)
+			for server.CurrentLoad() > 0 && time.Now().Before(deadline) {
 				lb.mu.Unlock()
 				time.Sleep(100 * time.Millisecond)
 				lb.mu.Lock()
 			}
+			if server.CurrentLoad() > 0 {
+				// Long-lived connections would hold the server forever
+				lb.Logger.Println(utils.Colorize("Closing the remaining connections of server "+url, utils.YELLOW))
+				server.CloseConns()
+			}
 
-			// Remove server
+			// Remove server, unless a concurrent call already did
+			i = slices.Index(lb.Servers, server)
+			if i < 0 {
+				break
+			}
 			lb.Servers = append(lb.Servers[:i], lb.Servers[i+1:]...)
 			lb.Logger.Println(utils.Colorize("Removed server "+url, utils.YELLOW))
 			return nil
@@ -94,42 +145,64 @@ func (lb *LoadBalancer) RemoveServer(url string) error {
 }
 
 func (lb *LoadBalancer) GetMetrics() *Metrics {
-	return &Metrics{
-		TotalRequests:     atomic.LoadUint64(&lb.metrics.TotalRequests),
-		FailedRequests:    atomic.LoadUint64(&lb.metrics.FailedRequests),
-		ActiveConnections: atomic.LoadInt64(&lb.metrics.ActiveConnections),
+	metrics := &Metrics{
+		TotalRequests:        atomic.LoadUint64(&lb.metrics.TotalRequests),
+		FailedRequests:       atomic.LoadUint64(&lb.metrics.FailedRequests),
+		ActiveConnections:    atomic.LoadInt64(&lb.metrics.ActiveConnections),
+		Retries:              atomic.LoadUint64(&lb.metrics.Retries),
+		RetryBudgetExhausted: atomic.LoadUint64(&lb.metrics.RetryBudgetExhausted),
+		Hedges:               atomic.LoadUint64(&lb.metrics.Hedges),
+		HedgeWins:            atomic.LoadUint64(&lb.metrics.HedgeWins),
+		AffinityEntries:      lb.affinityTable.len(),
+		AffinityLookups:      atomic.LoadUint64(&lb.metrics.AffinityLookups),
+		AffinityHits:         atomic.LoadUint64(&lb.metrics.AffinityHits),
 	}
+	if metrics.Hedges > 0 {
+		metrics.HedgeWinRate = float64(metrics.HedgeWins) / float64(metrics.Hedges)
+	}
+	if metrics.AffinityLookups > 0 {
+		metrics.AffinityHitRate = float64(metrics.AffinityHits) / float64(metrics.AffinityLookups)
+	}
+	return metrics
 }
 
 func (lb *LoadBalancer) GetLeastLoadedServer() *sv.Server {
+	return lb.leastLoadedServer(nil)
+}
+
+func (lb *LoadBalancer) leastLoadedServer(exclude map[*sv.Server]bool) *sv.Server {
 	lb.mu.RLock()
 	defer lb.mu.RUnlock()
 
 	var leastLoadedServer *sv.Server
+	leastLoad := 0
 	for _, server := range lb.Servers {
-		healthy := server.Healthy
-		load := server.Load
-
-		if healthy && (leastLoadedServer == nil || load < leastLoadedServer.Load) {
-			server.Load = load
-			leastLoadedServer = server
+		if exclude[server] || lb.draining[server] || !server.IsHealthy() {
+			continue
+		}
+		if load := server.CurrentLoad(); leastLoadedServer == nil || load < leastLoad {
+			leastLoadedServer, leastLoad = server, load
 		}
 	}
 
 	if leastLoadedServer != nil {
-		lb.Logger.Println(utils.Colorize("Selected server "+leastLoadedServer.URL+" with load "+fmt.Sprint(leastLoadedServer.Load), utils.BLUE))
+		lb.Logger.Println(utils.Colorize("Selected server "+leastLoadedServer.URL+" with load "+fmt.Sprint(leastLoad), utils.BLUE))
 	}
 
 	return leastLoadedServer
 }
 
 func (lb *LoadBalancer) GetRoundRobinServer() *sv.Server {
+	return lb.roundRobinServer(nil)
+}
+
+func (lb *LoadBalancer) roundRobinServer(exclude map[*sv.Server]bool) *sv.Server {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 
 	var healthyServers []*sv.Server
 	for _, server := range lb.Servers {
-		if server.Healthy {
+		if !exclude[server] && !lb.draining[server] && server.IsHealthy() {
 			healthyServers = append(healthyServers, server)
 		}
 	}
@@ -148,14 +221,20 @@ func (lb *LoadBalancer) GetRoundRobinServer() *sv.Server {
 }
 
 func (lb *LoadBalancer) GetServer() *sv.Server {
+	return lb.nextServer(nil)
+}
+
+// nextServer picks a server with the configured strategy, skipping the ones
+// in exclude.
+func (lb *LoadBalancer) nextServer(exclude map[*sv.Server]bool) *sv.Server {
 	switch lb.strategy {
 	case "round_robin":
-		return lb.GetRoundRobinServer()
+		return lb.roundRobinServer(exclude)
 	case "least_active":
-		return lb.GetLeastLoadedServer()
+		return lb.leastLoadedServer(exclude)
 	default:
 		// Default to least active
-		return lb.GetLeastLoadedServer()
+		return lb.leastLoadedServer(exclude)
 	}
 }
 
@@ -165,33 +244,122 @@ func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	atomic.AddInt64(&lb.metrics.ActiveConnections, 1)
 	defer atomic.AddInt64(&lb.metrics.ActiveConnections, -1)
 
-	// Check if we're shutting down
+	// Check if we're shutting down, or else let GracefulShutdown wait for
+	// the request
+	lb.mu.Lock()
 	if lb.shutdown {
+		lb.mu.Unlock()
 		http.Error(w, "Service is shutting down", http.StatusServiceUnavailable)
 		return
 	}
+	lb.wg.Add(1)
+	lb.mu.Unlock()
+	defer lb.wg.Done()
+
+	// Let every attempt read the body from the start, if there can be more
+	// than one
+	grpc := sv.IsGRPC(r)
+	var replay *sv.ReplayBody
+	if r.Body != nil && r.Body != http.NoBody && lb.RetryPolicy.mayRetry(r) {
+		replay = sv.NewReplayBody(r.Body, lb.RetryPolicy.BufferBytes)
+		r.Body = replay
+	}
 
-	// Try multiple servers if needed
-	var err error
-	for retry := 0; retry < lb.maxRetries; retry++ {
-		server := lb.GetServer()
-		if server == nil {
+	// Try multiple servers if needed, never the same one twice, starting
+	// with the one the client is pinned to
+	lb.retryBudget.recordRequest()
+	lb.hedgeBudget.recordRequest()
+	tried := make(map[*sv.Server]bool)
+	pinned := lb.pinnedServer(r)
+	server := pinned
+	if server == nil {
+		server = lb.nextServer(tried)
+	}
+	attempt := 0
+	for server != nil {
+		tried[server] = true
+
+		var resp *http.Response
+		var err error
+		if attempt == 0 && pinned == nil && lb.HedgePolicy.hedgeable(r) {
+			server, resp, err = lb.forwardHedged(r, server, tried)
+		} else {
+			resp, err = server.Forward(r)
+		}
+		if err != nil {
+			lb.Logger.Printf("Request failed on server %s, attempt %d: %v", server.URL, attempt+1, err)
+			// An unhealthy server was never contacted, so moving on to the
+			// next one is not a retry
+			if sv.FailureKind(err) == sv.FailureUnhealthy {
+				server = lb.nextServer(tried)
+				continue
+			}
+			if !lb.RetryPolicy.retryableError(r, err) {
+				break
+			}
+			next := lb.nextServer(tried)
+			if next == nil || !lb.canRetry(r, attempt) {
+				break
+			}
+			server = next
+			attempt++
 			continue
 		}
 
-		err = server.HandleRequest(w, r)
-		if err == nil {
-			return
+		// A retryable response is only dropped if there is another server to
+		// try; otherwise the client gets it as is.
+		if lb.RetryPolicy.retryableResponse(r, resp) {
+			if next := lb.nextServer(tried); next != nil && lb.canRetry(r, attempt) {
+				lb.Logger.Printf("Request failed on server %s with status %d, attempt %d", server.URL, resp.StatusCode, attempt+1)
+				resp.Body.Close()
+				server = next
+				attempt++
+				continue
+			}
 		}
 
-		lb.Logger.Printf("Request failed on server %s, attempt %d: %v", server.URL, retry+1, err)
+		// The response is committed from here on, so it cannot be retried
+		if replay != nil {
+			replay.Commit()
+		}
+		lb.pin(w, r, resp, pinned, server)
+		if err := server.WriteResponse(w, resp); err != nil {
+			lb.Logger.Printf("Request failed on server %s, attempt %d: %v", server.URL, attempt+1, err)
+			atomic.AddUint64(&lb.metrics.FailedRequests, 1)
+		}
+		return
 	}
 
 	// All retries failed
 	atomic.AddUint64(&lb.metrics.FailedRequests, 1)
+	if grpc {
+		sv.WriteGRPCError(w, sv.GRPCUnavailable, "all servers failed to process the call")
+		return
+	}
 	http.Error(w, "All servers failed to process the request", http.StatusServiceUnavailable)
 }
 
+// canRetry reports whether another attempt may follow attempt, taking it
+// from the retry budget and backing off first.
+func (lb *LoadBalancer) canRetry(r *http.Request, attempt int) bool {
+	if attempt >= lb.RetryPolicy.MaxRetries {
+		return false
+	}
+	if rb, ok := r.Body.(*sv.ReplayBody); ok && !rb.Replayable() {
+		return false // the body was too long to keep
+	}
+	if !lb.retryBudget.withdraw(lb.RetryPolicy.BudgetPercent, lb.RetryPolicy.MinRetriesPerSecond) {
+		atomic.AddUint64(&lb.metrics.RetryBudgetExhausted, 1)
+		lb.Logger.Println(utils.Colorize("Retry budget exhausted, not retrying", utils.YELLOW))
+		return false
+	}
+	if !lb.RetryPolicy.backoff(r.Context(), attempt+1) {
+		return false // the client gave up while backing off
+	}
+	atomic.AddUint64(&lb.metrics.Retries, 1)
+	return true
+}
+
 func (lb *LoadBalancer) StartHealthChecks(interval time.Duration) {
 	for _, server := range lb.Servers {
 		go func(s *sv.Server) {
@@ -212,8 +380,23 @@ func (lb *LoadBalancer) GracefulShutdown() {
 	lb.shutdown = true
 	lb.mu.Unlock()
 
-	// Wait for ongoing requests to complete
-	lb.wg.Wait()
+	// Wait for ongoing requests to complete, then close the connections
+	// still open
+	done := make(chan struct{})
+	go func() {
+		lb.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(lb.DrainTimeout):
+		lb.mu.RLock()
+		for _, server := range lb.Servers {
+			server.CloseConns()
+		}
+		lb.mu.RUnlock()
+		lb.Logger.Println(utils.Colorize("Closed the connections still open after the drain timeout", utils.YELLOW))
+	}
 
 	lb.Logger.Println(utils.Colorize("All servers have been shut down, and connections are closed.", utils.YELLOW))
 }
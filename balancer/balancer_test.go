@@ -0,0 +1,871 @@
+package balancer
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingBackend starts a backend that answers with status and counts its hits.
+func countingBackend(status int, hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		w.WriteHeader(status)
+	}))
+}
+
+func newTestBalancer(t *testing.T, backends ...*httptest.Server) *LoadBalancer {
+	lb := NewLoadBalancer(nil, "round_robin")
+	for _, b := range backends {
+		if err := lb.AddServer(b.URL); err != nil {
+			t.Fatalf("failed to add server: %v", err)
+		}
+	}
+	return lb
+}
+
+func TestRetryIdempotentOnStatus(t *testing.T) {
+	var failedHits, okHits int32
+	failed := countingBackend(http.StatusServiceUnavailable, &failedHits)
+	defer failed.Close()
+	ok := countingBackend(http.StatusOK, &okHits)
+	defer ok.Close()
+
+	lb := newTestBalancer(t, failed, ok)
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected GET to be retried to status 200, got %d", w.Code)
+	}
+	if failedHits != 1 || okHits != 1 {
+		t.Errorf("expected one hit on each server, got %d and %d", failedHits, okHits)
+	}
+}
+
+func TestNoRetryForNonIdempotentMethod(t *testing.T) {
+	var failedHits, okHits int32
+	failed := countingBackend(http.StatusServiceUnavailable, &failedHits)
+	defer failed.Close()
+	ok := countingBackend(http.StatusOK, &okHits)
+	defer ok.Close()
+
+	lb := newTestBalancer(t, failed, ok)
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("order")))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the backend's 503 to be passed through, got %d", w.Code)
+	}
+	if okHits != 0 {
+		t.Errorf("expected POST not to be replayed, got %d hits on the second server", okHits)
+	}
+}
+
+func TestNoRetryOnSameServer(t *testing.T) {
+	var hits int32
+	failed := countingBackend(http.StatusServiceUnavailable, &hits)
+	defer failed.Close()
+
+	lb := newTestBalancer(t, failed)
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if hits != 1 {
+		t.Errorf("expected a single attempt, got %d", hits)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", w.Code)
+	}
+}
+
+func TestNoRetryAfterResponseCommitted(t *testing.T) {
+	var brokenHits, okHits int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&brokenHits, 1)
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		http.NewResponseController(w).Flush()
+		conn, _, _ := http.NewResponseController(w).Hijack()
+		conn.Close()
+	}))
+	defer broken.Close()
+	ok := countingBackend(http.StatusOK, &okHits)
+	defer ok.Close()
+
+	lb := newTestBalancer(t, broken, ok)
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if okHits != 0 {
+		t.Errorf("expected no retry once the response was sent, got %d hits on the second server", okHits)
+	}
+	if w.Body.String() != "partial" {
+		t.Errorf("expected only the first response to be written, got %q", w.Body.String())
+	}
+	if lb.GetMetrics().FailedRequests != 1 {
+		t.Errorf("expected the request to be counted as failed")
+	}
+}
+
+func TestRetryOnConnectFailure(t *testing.T) {
+	var okHits int32
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	ok := countingBackend(http.StatusOK, &okHits)
+	defer ok.Close()
+
+	lb := newTestBalancer(t, down, ok)
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusOK || okHits != 1 {
+		t.Errorf("expected connect failure to be retried, got status %d", w.Code)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var b budget
+	for i := 0; i < 10; i++ {
+		b.recordRequest()
+	}
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if b.withdraw(20, 0) {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("expected 2 retries for 10 requests at 20%%, got %d", allowed)
+	}
+}
+
+func TestRetryBudgetExhaustedMetric(t *testing.T) {
+	var failedHits, okHits int32
+	failed := countingBackend(http.StatusServiceUnavailable, &failedHits)
+	defer failed.Close()
+	ok := countingBackend(http.StatusOK, &okHits)
+	defer ok.Close()
+
+	lb := newTestBalancer(t, failed, ok)
+	lb.RetryPolicy.BudgetPercent = 1
+	lb.RetryPolicy.MinRetriesPerSecond = 0
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the 503 to be passed through without a retry, got %d", w.Code)
+	}
+	metrics := lb.GetMetrics()
+	if metrics.RetryBudgetExhausted != 1 || metrics.Retries != 0 {
+		t.Errorf("expected 1 exhausted budget and 0 retries, got %d and %d", metrics.RetryBudgetExhausted, metrics.Retries)
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	var hits int32
+	var backends []*httptest.Server
+	for i := 0; i < 3; i++ {
+		b := countingBackend(http.StatusServiceUnavailable, &hits)
+		defer b.Close()
+		backends = append(backends, b)
+	}
+
+	lb := newTestBalancer(t, backends...)
+	lb.RetryPolicy.MaxRetries = 1
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if hits != 2 {
+		t.Errorf("expected 2 attempts with MaxRetries 1, got %d", hits)
+	}
+	if lb.GetMetrics().Retries != 1 {
+		t.Errorf("expected 1 retry in metrics, got %d", lb.GetMetrics().Retries)
+	}
+}
+
+func TestRetryBodyBuffer(t *testing.T) {
+	var hits int32
+	var backends []*httptest.Server
+	for i := 0; i < 2; i++ {
+		b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer b.Close()
+		backends = append(backends, b)
+	}
+
+	lb := newTestBalancer(t, backends...)
+	lb.RetryPolicy.MaxRetries = 1
+	lb.RetryPolicy.BufferBytes = 8
+	for body, attempts := range map[string]int32{"short": 2, "longer than the buffer": 1} {
+		hits = 0
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body)))
+		if hits != attempts {
+			t.Errorf("%q: expected %d attempts, got %d", body, attempts, hits)
+		}
+	}
+}
+
+func TestNoRetryCountedWhenBackoffCancelled(t *testing.T) {
+	var hits int32
+	var backends []*httptest.Server
+	for i := 0; i < 2; i++ {
+		b := countingBackend(http.StatusServiceUnavailable, &hits)
+		defer b.Close()
+		backends = append(backends, b)
+	}
+
+	lb := newTestBalancer(t, backends...)
+	lb.RetryPolicy.BackoffBase = time.Hour
+	lb.RetryPolicy.BackoffMax = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+
+	if hits != 1 {
+		t.Errorf("expected no attempt after the client gave up, got %d", hits)
+	}
+	if retries := lb.GetMetrics().Retries; retries != 0 {
+		t.Errorf("expected no retry in metrics, got %d", retries)
+	}
+}
+
+func TestGracefulShutdownWaitsForRequests(t *testing.T) {
+	started := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+	lb := newTestBalancer(t, backend)
+
+	inFlight := httptest.NewRecorder()
+	go lb.ServeHTTP(inFlight, httptest.NewRequest(http.MethodGet, "/", nil))
+	<-started
+	lb.GracefulShutdown()
+	if inFlight.Body.String() != "done" {
+		t.Error("expected shutdown to wait for the request in flight")
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected requests after shutdown to be refused, got %d", w.Code)
+	}
+}
+
+func TestHedgedRequest(t *testing.T) {
+	cancelled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	var fastHits int32
+	fast := countingBackend(http.StatusOK, &fastHits)
+	defer fast.Close()
+
+	lb := newTestBalancer(t, slow, fast)
+	lb.HedgePolicy = HedgePolicy{Enabled: true, Delay: 20 * time.Millisecond}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusOK || fastHits != 1 {
+		t.Errorf("expected the hedge to answer with 200, got %d", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the hedge to cut latency, took %v", elapsed)
+	}
+	metrics := lb.GetMetrics()
+	if metrics.Hedges != 1 || metrics.HedgeWins != 1 || metrics.HedgeWinRate != 1 {
+		t.Errorf("expected 1 hedge and 1 win, got %d and %d", metrics.Hedges, metrics.HedgeWins)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("expected the slow attempt to be cancelled")
+	}
+}
+
+func TestHedgeLoserStaysHealthy(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	var fastHits int32
+	fast := countingBackend(http.StatusOK, &fastHits)
+	defer fast.Close()
+
+	lb := NewLoadBalancer(nil, "round_robin")
+	lb.HedgePolicy = HedgePolicy{Enabled: true, Delay: 20 * time.Millisecond}
+	lb.ServerOptions.OutlierFailures = 1
+	for _, b := range []*httptest.Server{slow, fast} {
+		if err := lb.AddServer(b.URL); err != nil {
+			t.Fatalf("failed to add server: %v", err)
+		}
+	}
+
+	for range 4 {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	if lb.GetMetrics().HedgeWins == 0 {
+		t.Fatal("expected a hedge to win")
+	}
+	for _, s := range lb.Servers {
+		if !s.IsHealthy() {
+			t.Errorf("expected %s to stay healthy after its attempt was cancelled", s.URL)
+		}
+	}
+}
+
+func TestHedgeable(t *testing.T) {
+	policy := HedgePolicy{Enabled: true}
+	if !policy.hedgeable(httptest.NewRequest(http.MethodGet, "/", nil)) {
+		t.Error("expected GET to be hedged")
+	}
+	if policy.hedgeable(httptest.NewRequest(http.MethodPost, "/", strings.NewReader("x"))) {
+		t.Error("expected POST not to be hedged")
+	}
+	policy.Enabled = false
+	if policy.hedgeable(httptest.NewRequest(http.MethodGet, "/", nil)) {
+		t.Error("expected no hedging when disabled")
+	}
+}
+
+// namedBackend starts a backend that answers with its name.
+func namedBackend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+}
+
+func TestCookieAffinity(t *testing.T) {
+	var backends []*httptest.Server
+	for _, name := range []string{"a", "b", "c"} {
+		b := namedBackend(name)
+		defer b.Close()
+		backends = append(backends, b)
+	}
+	lb := newTestBalancer(t, backends...)
+	lb.AffinityPolicy.Mode = AffinityCookie
+	lb.AffinityPolicy.Cookie.MaxAge = 60
+	lb.AffinityPolicy.Cookie.Secure = true
+
+	serve := func(cookie *http.Cookie) (string, *http.Cookie) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		var issued *http.Cookie
+		for _, c := range w.Result().Cookies() {
+			if c.Name == "lb_affinity" {
+				issued = c
+			}
+		}
+		return w.Body.String(), issued
+	}
+
+	first, cookie := serve(nil)
+	if cookie == nil {
+		t.Fatal("expected the first response to set an affinity cookie")
+	}
+	if cookie.MaxAge != 60 || !cookie.Secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/" {
+		t.Errorf("unexpected cookie attributes %+v", cookie)
+	}
+	if strings.Contains(cookie.Value, backends[0].URL) {
+		t.Errorf("expected the cookie not to reveal the server, got %q", cookie.Value)
+	}
+
+	for range 5 {
+		got, issued := serve(cookie)
+		if got != first {
+			t.Fatalf("expected requests to stay on %s, got %s", first, got)
+		}
+		if issued != nil {
+			t.Errorf("expected no new cookie while pinned, got %+v", issued)
+		}
+	}
+
+	// Taken out of rotation, the server's clients are re-pinned
+	for _, s := range lb.Servers {
+		if s.URL == backends[strings.Index("abc", first)].URL {
+			s.Healthy = false
+		}
+	}
+	second, cookie := serve(cookie)
+	if second == first || cookie == nil {
+		t.Fatalf("expected to be re-pinned away from %s, got %s with cookie %v", first, second, cookie)
+	}
+	if got, _ := serve(cookie); got != second {
+		t.Errorf("expected to stay on %s after re-pinning, got %s", second, got)
+	}
+
+	// So are clients of a removed server
+	if err := lb.RemoveServer(backends[strings.Index("abc", second)].URL); err != nil {
+		t.Fatalf("failed to remove server: %v", err)
+	}
+	third, cookie := serve(cookie)
+	if third == second || third == first || cookie == nil {
+		t.Errorf("expected to be re-pinned to the last server, got %s with cookie %v", third, cookie)
+	}
+}
+
+func TestVerifyAffinity(t *testing.T) {
+	lb := NewLoadBalancer(nil, "")
+	lb.AffinityPolicy.Secret = []byte("secret")
+	other := NewLoadBalancer(nil, "")
+	other.AffinityPolicy.Secret = []byte("other")
+
+	now := time.Now()
+	valid := lb.signAffinity("0123456789abcdef", now.Add(time.Minute).Unix())
+	tests := map[string]struct {
+		value string
+		ok    bool
+	}{
+		"valid":             {valid, true},
+		"no expiry":         {lb.signAffinity("0123456789abcdef", 0), true},
+		"expired":           {lb.signAffinity("0123456789abcdef", now.Unix()-1), false},
+		"other server":      {strings.Replace(valid, "0123", "3210", 1), false},
+		"other secret":      {other.signAffinity("0123456789abcdef", 0), false},
+		"unsigned":          {"0123456789abcdef.0", false},
+		"garbage":           {"not-a-cookie", false},
+		"empty":             {"", false},
+		"extended lifetime": {strings.Replace(valid, ".", ".9", 1), false},
+	}
+	for name, tc := range tests {
+		id, ok := lb.verifyAffinity(tc.value, now)
+		if ok != tc.ok || (ok && id != "0123456789abcdef") {
+			t.Errorf("%s: got %q, %v", name, id, ok)
+		}
+	}
+}
+
+func TestApplicationAffinity(t *testing.T) {
+	var backends []*httptest.Server
+	for _, name := range []string{"a", "b", "c"} {
+		b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/login":
+				http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "session-" + name})
+			case "/logout":
+				http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", MaxAge: -1})
+			case "/expire":
+				http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "gone", Expires: time.Unix(1, 0)})
+			}
+			io.WriteString(w, name)
+		}))
+		defer b.Close()
+		backends = append(backends, b)
+	}
+	lb := newTestBalancer(t, backends...)
+	lb.AffinityPolicy.Mode = AffinityLearn
+	lb.AffinityPolicy.Cookie.Name = "JSESSIONID"
+
+	serve := func(path string, cookie *http.Cookie) (string, []*http.Cookie) {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		return w.Body.String(), w.Result().Cookies()
+	}
+
+	first, cookies := serve("/login", nil)
+	if len(cookies) != 1 || cookies[0].Value != "session-"+first {
+		t.Fatalf("expected only the application's cookie, got %v", cookies)
+	}
+	for range 5 {
+		if got, _ := serve("/", cookies[0]); got != first {
+			t.Fatalf("expected requests to stay on %s, got %s", first, got)
+		}
+	}
+
+	// Unknown sessions are balanced as usual
+	serve("/", &http.Cookie{Name: "JSESSIONID", Value: "unknown"})
+
+	metrics := lb.GetMetrics()
+	if metrics.AffinityEntries != 1 || metrics.AffinityLookups != 6 || metrics.AffinityHits != 5 {
+		t.Errorf("unexpected affinity metrics %+v", metrics)
+	}
+	if metrics.AffinityHitRate != 5.0/6 {
+		t.Errorf("expected a hit rate of 5/6, got %v", metrics.AffinityHitRate)
+	}
+
+	// The session moves with a server that is taken out of rotation
+	for _, s := range lb.Servers {
+		if s.URL == backends[strings.Index("abc", first)].URL {
+			s.Healthy = false
+		}
+	}
+	if got, _ := serve("/", cookies[0]); got == first {
+		t.Errorf("expected the session to leave unhealthy server %s", first)
+	}
+
+	// Sessions the application deletes are forgotten
+	for _, path := range []string{"/logout", "/expire"} {
+		_, cookies := serve("/login", nil)
+		before := lb.GetMetrics().AffinityEntries
+		serve(path, cookies[0])
+		if after := lb.GetMetrics().AffinityEntries; after != before-1 {
+			t.Errorf("%s: expected %d affinity entries, got %d", path, before-1, after)
+		}
+	}
+}
+
+func TestAffinityTable(t *testing.T) {
+	var table affinityTable
+	now := time.Now()
+
+	if _, ok := table.get("missing", time.Minute, now); ok {
+		t.Error("expected an empty table to find nothing")
+	}
+
+	table.put("a", "server-1", 2, now)
+	table.put("b", "server-2", 2, now)
+	table.get("a", time.Minute, now) // a is now used more recently than b
+	table.put("c", "server-3", 2, now)
+	if table.len() != 2 {
+		t.Errorf("expected the table to be bounded to 2 entries, got %d", table.len())
+	}
+	if _, ok := table.get("b", time.Minute, now); ok {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+	if id, ok := table.get("a", time.Minute, now); !ok || id != "server-1" {
+		t.Errorf("expected a to be kept, got %q, %v", id, ok)
+	}
+
+	table.put("c", "server-1", 2, now)
+	if id, _ := table.get("c", time.Minute, now); id != "server-1" {
+		t.Errorf("expected c to move to server-1, got %q", id)
+	}
+
+	if _, ok := table.get("a", time.Minute, now.Add(2*time.Minute)); ok {
+		t.Error("expected an entry unused for longer than the TTL to expire")
+	}
+	if table.len() != 1 {
+		t.Errorf("expected the expired entry to be dropped, got %d entries", table.len())
+	}
+}
+
+// echoServer starts a TCP server that echoes its name followed by whatever
+// it receives, and returns its tcp:// URL.
+func echoServer(t *testing.T, name string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, name+":")
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return "tcp://" + ln.Addr().String()
+}
+
+func TestServeTCP(t *testing.T) {
+	// A server nobody listens on is skipped, and taken out of rotation
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+
+	lb := NewLoadBalancer(nil, "round_robin")
+	lb.ServerOptions.OutlierFailures = 1
+	urls := map[string]string{"a": echoServer(t, "a"), "b": echoServer(t, "b")}
+	for _, url := range []string{"tcp://" + closed.Addr().String(), urls["a"], urls["b"]} {
+		if err := lb.AddServer(url); err != nil {
+			t.Fatalf("failed to add server: %v", err)
+		}
+	}
+	load := func(name string) int {
+		for _, s := range lb.Servers {
+			if s.URL == urls[name] {
+				return s.CurrentLoad()
+			}
+		}
+		return -1
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go lb.ServeTCP(ln)
+	defer ln.Close()
+
+	// dial opens a connection and returns the name of the server it reached
+	dial := func() (net.Conn, string) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		io.WriteString(conn, "ping")
+		buf := make([]byte, 6)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		name, echo, _ := strings.Cut(string(buf), ":")
+		if echo != "ping" {
+			t.Fatalf("expected bytes to be spliced through, got %q", buf)
+		}
+		return conn, name
+	}
+
+	first, name := dial()
+	if name != "a" && name != "b" {
+		t.Fatalf("expected a reachable server, got %q", name)
+	}
+	other := map[string]string{"a": "b", "b": "a"}[name]
+	second, got := dial()
+	if got != other {
+		t.Errorf("expected round robin to %s, got %s", other, got)
+	}
+	if load(name) != 1 || load(other) != 1 {
+		t.Errorf("expected each open connection to count as load, got %d and %d", load(name), load(other))
+	}
+
+	// Removing a server waits for its connections to close, and sends no
+	// new ones its way meanwhile
+	removed := make(chan struct{})
+	go func() {
+		lb.RemoveServer(urls[name])
+		close(removed)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	for range 2 {
+		conn, got := dial()
+		if got != other {
+			t.Errorf("expected new connections to avoid the draining server, got %s", got)
+		}
+		conn.Close()
+	}
+	select {
+	case <-removed:
+		t.Fatal("expected the server to be removed only once its connections closed")
+	default:
+	}
+	first.Close()
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		t.Fatal("expected the server to be removed once its connections closed")
+	}
+	second.Close()
+
+	metrics := lb.GetMetrics()
+	if metrics.TotalRequests != 4 || metrics.FailedRequests != 0 {
+		t.Errorf("unexpected metrics %+v", metrics)
+	}
+}
+
+// udpEchoServer starts a UDP server that answers each datagram with its
+// name, followed by the datagram.
+func udpEchoServer(t *testing.T, name string) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(append([]byte(name+":"), buf[:n]...), addr)
+		}
+	}()
+	return "udp://" + pc.LocalAddr().String()
+}
+
+func TestServeUDP(t *testing.T) {
+	for _, perPacket := range []bool{false, true} {
+		lb := NewLoadBalancer(nil, "round_robin")
+		lb.UDPPolicy.PerPacket = perPacket
+		lb.UDPPolicy.SessionIdle = 100 * time.Millisecond
+		for _, name := range []string{"a", "b"} {
+			if err := lb.AddServer(udpEchoServer(t, name)); err != nil {
+				t.Fatalf("failed to add server: %v", err)
+			}
+		}
+
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		go lb.ServeUDP(pc)
+
+		// send sends a datagram from conn and returns the name of the server
+		// that replied
+		send := func(conn net.Conn) string {
+			conn.Write([]byte("ping"))
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 64)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("failed to read reply: %v", err)
+			}
+			name, echo, _ := strings.Cut(string(buf[:n]), ":")
+			if echo != "ping" {
+				t.Fatalf("expected the datagram to be relayed, got %q", buf[:n])
+			}
+			return name
+		}
+
+		conn, err := net.Dial("udp", pc.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		var names []string
+		for range 4 {
+			names = append(names, send(conn))
+		}
+		for i := 1; i < len(names); i++ {
+			if perPacket && names[i] == names[i-1] {
+				t.Errorf("expected each datagram to go to the next server, got %v", names)
+			}
+			if !perPacket && names[i] != names[0] {
+				t.Errorf("expected a session to stay on one server, got %v", names)
+			}
+		}
+		if active := lb.GetMetrics().ActiveConnections; active != 1 {
+			t.Errorf("expected 1 active session, got %d", active)
+		}
+
+		// Sessions end once idle, releasing their servers
+		time.Sleep(300 * time.Millisecond)
+		if active := lb.GetMetrics().ActiveConnections; active != 0 {
+			t.Errorf("expected the idle session to end, got %d active", active)
+		}
+		for _, s := range lb.Servers {
+			if load := s.CurrentLoad(); load != 0 {
+				t.Errorf("expected %s to be released, got load %d", s.URL, load)
+			}
+		}
+		if name := send(conn); name == "" {
+			t.Error("expected a new session to start")
+		}
+
+		metrics := lb.GetMetrics()
+		if metrics.TotalRequests != 5 || metrics.FailedRequests != 0 {
+			t.Errorf("unexpected metrics %+v", metrics)
+		}
+		conn.Close()
+		pc.Close()
+	}
+}
+
+func TestServeUDPMaxSessions(t *testing.T) {
+	lb := NewLoadBalancer(nil, "round_robin")
+	lb.UDPPolicy.MaxSessions = 1
+	if err := lb.AddServer(udpEchoServer(t, "a")); err != nil {
+		t.Fatalf("failed to add server: %v", err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer pc.Close()
+	go lb.ServeUDP(pc)
+
+	var replies []bool
+	for range 2 {
+		conn, err := net.Dial("udp", pc.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("ping"))
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 64))
+		replies = append(replies, err == nil)
+	}
+	if !replies[0] || replies[1] {
+		t.Errorf("expected only the first client to be served, got replies %v", replies)
+	}
+	if metrics := lb.GetMetrics(); metrics.ActiveConnections != 1 || metrics.FailedRequests != 1 {
+		t.Errorf("expected one session and one dropped datagram, got %+v", metrics)
+	}
+}
+
+func TestRemoveServerDrainTimeout(t *testing.T) {
+	lb := NewLoadBalancer(nil, "round_robin")
+	lb.DrainTimeout = 100 * time.Millisecond
+	url := echoServer(t, "a")
+	if err := lb.AddServer(url); err != nil {
+		t.Fatalf("failed to add server: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go lb.ServeTCP(ln)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+
+	// A connection that stays open is closed once the drain timeout passes,
+	// and overlapping removals of the same server do not both succeed
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() { errs <- lb.RemoveServer(url) }()
+	}
+	var failed int
+	for range 2 {
+		select {
+		case err := <-errs:
+			if err != nil {
+				failed++
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected removal to finish after the drain timeout")
+		}
+	}
+	if failed != 1 || len(lb.Servers) != 0 {
+		t.Errorf("expected one removal to succeed, got %d failures and %d servers", failed, len(lb.Servers))
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(buf); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
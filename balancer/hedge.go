@@ -0,0 +1,156 @@
+package balancer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	sv "loadbalancer/server"
+)
+
+// HedgePolicy controls hedged requests: when the first server has not
+// answered an idempotent GET or HEAD within Delay, a second attempt goes to
+// another server and whichever answers first is used.
+type HedgePolicy struct {
+	Enabled bool
+
+	// Delay is how long to wait before hedging. Zero uses the pool's p95
+	// response time.
+	Delay time.Duration
+
+	// BudgetPercent caps hedges at this percentage of recent requests.
+	// Zero means no cap.
+	BudgetPercent float64
+}
+
+// DefaultHedgePolicy leaves hedging off, with a 10% budget once enabled.
+func DefaultHedgePolicy() HedgePolicy {
+	return HedgePolicy{BudgetPercent: 10}
+}
+
+// hedgeable reports whether r may be sent to two servers at once.
+func (p HedgePolicy) hedgeable(r *http.Request) bool {
+	if !p.Enabled || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	return r.Body == nil || r.Body == http.NoBody
+}
+
+// hedgeDelay returns how long to wait for the first server before hedging,
+// or false if there is nothing to base it on yet.
+func (lb *LoadBalancer) hedgeDelay() (time.Duration, bool) {
+	if lb.HedgePolicy.Delay > 0 {
+		return lb.HedgePolicy.Delay, true
+	}
+
+	lb.mu.RLock()
+	var times []time.Duration
+	for _, server := range lb.Servers {
+		times = append(times, server.RecentResponseTimes()...)
+	}
+	lb.mu.RUnlock()
+
+	if len(times) == 0 {
+		return 0, false
+	}
+	slices.Sort(times)
+	return times[len(times)*95/100], true
+}
+
+type hedgeResult struct {
+	server *sv.Server
+	resp   *http.Response
+	err    error
+}
+
+// forwardHedged forwards r to server and, if it is slow to answer, to a
+// second server too. It returns the first successful response and cancels
+// the other attempt. Servers it sends to are added to tried.
+func (lb *LoadBalancer) forwardHedged(r *http.Request, server *sv.Server, tried map[*sv.Server]bool) (*sv.Server, *http.Response, error) {
+	delay, ok := lb.hedgeDelay()
+	if !ok {
+		resp, err := server.Forward(r)
+		return server, resp, err
+	}
+
+	results := make(chan hedgeResult, 2)
+	cancels := make(map[*sv.Server]context.CancelFunc)
+	send := func(s *sv.Server) {
+		ctx, cancel := context.WithCancel(r.Context())
+		cancels[s] = cancel
+		go func() {
+			resp, err := s.Forward(r.WithContext(ctx))
+			results <- hedgeResult{server: s, resp: resp, err: err}
+		}()
+	}
+	send(server)
+	pending := 1
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var hedge *sv.Server
+	var last hedgeResult
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			hedge = lb.nextServer(tried)
+			if hedge == nil {
+				continue
+			}
+			if !lb.hedgeBudget.withdraw(lb.HedgePolicy.BudgetPercent, 0) {
+				hedge = nil
+				continue
+			}
+			tried[hedge] = true
+			atomic.AddUint64(&lb.metrics.Hedges, 1)
+			lb.Logger.Printf("Hedging request to server %s after %v", hedge.URL, delay)
+			send(hedge)
+			pending++
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				cancels[res.server]()
+				last = res
+				continue
+			}
+
+			if res.server == hedge {
+				atomic.AddUint64(&lb.metrics.HedgeWins, 1)
+			}
+			for s, cancel := range cancels {
+				if s != res.server {
+					cancel()
+				}
+			}
+			if pending > 0 {
+				go discardHedge(results)
+			}
+			// Release the winner's context once its body is done with
+			res.resp.Body = &cancelOnClose{ReadCloser: res.resp.Body, cancel: cancels[res.server]}
+			return res.server, res.resp, nil
+		}
+	}
+	return last.server, nil, last.err
+}
+
+// discardHedge frees the response of the attempt that lost the race.
+func discardHedge(results <-chan hedgeResult) {
+	if res := <-results; res.resp != nil {
+		res.resp.Body.Close()
+	}
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,186 @@
+package balancer
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	sv "loadbalancer/server"
+)
+
+// Conditions a RetryPolicy can retry on, besides HTTP status codes such as "503".
+const (
+	RetryOnConnectFailure = sv.FailureConnect
+	RetryOnTimeout        = sv.FailureTimeout
+)
+
+// RetryPolicy decides which failed attempts are tried again on another server.
+// An attempt is only retried while nothing has been sent to the client.
+type RetryPolicy struct {
+	// MaxRetries is the number of attempts made after the first one.
+	MaxRetries int
+
+	// BudgetPercent caps retries at this percentage of the requests seen in
+	// the last ten seconds, so a brownout does not turn into a retry storm.
+	// MinRetriesPerSecond are always allowed so quiet pools can still retry.
+	// A zero BudgetPercent disables the budget.
+	BudgetPercent       float64
+	MinRetriesPerSecond int
+
+	// BackoffBase and BackoffMax bound the exponential backoff between
+	// attempts. Each wait is drawn at random up to the current bound.
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+
+	// Methods lists the request methods that may be retried.
+	Methods []string
+
+	// RetryOn lists the failures that are retried: "connect-failure",
+	// "timeout", or a response status code such as "503".
+	RetryOn []string
+
+	// GRPCRetryableCodes lists the grpc-status codes a gRPC call is retried on.
+	// gRPC calls are not retried for any other reason.
+	GRPCRetryableCodes []int
+
+	// BufferBytes bounds how much of a request body is kept so it can be
+	// sent again. Requests with longer bodies are not retried once that much
+	// has been sent. Zero means no limit.
+	BufferBytes int
+}
+
+// DefaultRetryPolicy retries idempotent methods twice on connection failures,
+// timeouts and 502, 503 and 504 responses, within a 20% retry budget, and
+// keeps up to 1 MiB of request bodies for them.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:          2,
+		BudgetPercent:       20,
+		MinRetriesPerSecond: 10,
+		BackoffBase:         25 * time.Millisecond,
+		BackoffMax:          250 * time.Millisecond,
+		Methods:             []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete},
+		RetryOn:             []string{RetryOnConnectFailure, RetryOnTimeout, "502", "503", "504"},
+		BufferBytes:         1 << 20,
+	}
+}
+
+// mayRetry reports whether r could be retried at all, which makes its body
+// worth keeping.
+func (p RetryPolicy) mayRetry(r *http.Request) bool {
+	if p.MaxRetries <= 0 {
+		return false
+	}
+	if sv.IsGRPC(r) {
+		return len(p.GRPCRetryableCodes) > 0
+	}
+	return slices.Contains(p.Methods, r.Method)
+}
+
+// retryableError reports whether an attempt that got no response may be retried.
+func (p RetryPolicy) retryableError(r *http.Request, err error) bool {
+	kind := sv.FailureKind(err)
+	if kind == sv.FailureUnhealthy {
+		return true // nothing was sent
+	}
+	if sv.IsGRPC(r) || !slices.Contains(p.Methods, r.Method) {
+		return false
+	}
+	return slices.Contains(p.RetryOn, kind)
+}
+
+// retryableResponse reports whether resp should be discarded in favour of
+// another attempt.
+func (p RetryPolicy) retryableResponse(r *http.Request, resp *http.Response) bool {
+	if sv.IsGRPC(r) {
+		code, ok := sv.GRPCStatus(resp.Header)
+		return ok && slices.Contains(p.GRPCRetryableCodes, code)
+	}
+	if !slices.Contains(p.Methods, r.Method) {
+		return false
+	}
+	return slices.Contains(p.RetryOn, strconv.Itoa(resp.StatusCode))
+}
+
+// backoff waits before retry number attempt (starting at 1), using
+// exponential backoff with full jitter. It returns false if the request was
+// cancelled meanwhile.
+func (p RetryPolicy) backoff(ctx context.Context, attempt int) bool {
+	if p.BackoffBase <= 0 {
+		return ctx.Err() == nil
+	}
+	bound := p.BackoffBase << (attempt - 1)
+	if bound <= 0 || (p.BackoffMax > 0 && bound > p.BackoffMax) {
+		bound = p.BackoffMax
+	}
+	wait := time.Duration(rand.Int64N(int64(bound) + 1))
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// budgetWindow is the number of one-second buckets a budget remembers.
+const budgetWindow = 10
+
+// budget counts requests and extra attempts (retries or hedges) over a
+// sliding window so the extra attempts can be held to a share of the traffic.
+type budget struct {
+	mu       sync.Mutex
+	requests [budgetWindow]int
+	spent    [budgetWindow]int
+	seconds  [budgetWindow]int64
+}
+
+// bucket returns the index for now, clearing it if it belongs to an older second.
+func (b *budget) bucket(now time.Time) int {
+	sec := now.Unix()
+	i := int(sec % budgetWindow)
+	if b.seconds[i] != sec {
+		b.seconds[i] = sec
+		b.requests[i] = 0
+		b.spent[i] = 0
+	}
+	return i
+}
+
+func (b *budget) recordRequest() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requests[b.bucket(time.Now())]++
+}
+
+// withdraw takes one attempt from the budget, reporting false if none is
+// left. Up to percent of the recent requests are allowed, and never fewer
+// than minPerSecond. A zero percent disables the cap.
+func (b *budget) withdraw(percent float64, minPerSecond int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	current := b.bucket(now)
+	if percent > 0 {
+		var requests, spent int
+		for i := range b.seconds {
+			if now.Unix()-b.seconds[i] < budgetWindow {
+				requests += b.requests[i]
+				spent += b.spent[i]
+			}
+		}
+		allowed := max(int(float64(requests)*percent/100), minPerSecond*budgetWindow)
+		if spent >= allowed {
+			return false
+		}
+	}
+	b.spent[current]++
+	return true
+}
@@ -0,0 +1,67 @@
+package balancer
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+
+	sv "loadbalancer/server"
+	"loadbalancer/utils"
+)
+
+// ServeTCP accepts connections on ln and proxies each one to a server, until
+// ln is closed.
+func (lb *LoadBalancer) ServeTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		go lb.ServeConn(conn)
+	}
+}
+
+// ServeConn proxies conn to a server picked with the configured strategy and
+// closes it when done. Servers that cannot be reached are skipped, as
+// nothing has been sent to them yet; once connected, the connection is not
+// moved elsewhere.
+func (lb *LoadBalancer) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	atomic.AddUint64(&lb.metrics.TotalRequests, 1)
+	atomic.AddInt64(&lb.metrics.ActiveConnections, 1)
+	defer atomic.AddInt64(&lb.metrics.ActiveConnections, -1)
+
+	lb.mu.Lock()
+	if lb.shutdown {
+		lb.mu.Unlock()
+		return
+	}
+	lb.wg.Add(1)
+	lb.mu.Unlock()
+	defer lb.wg.Done()
+
+	tried := make(map[*sv.Server]bool)
+	for server := lb.nextServer(tried); server != nil; server = lb.nextServer(tried) {
+		tried[server] = true
+		err := server.ProxyConn(conn)
+		if err == nil {
+			return
+		}
+		if kind := sv.FailureKind(err); kind != sv.FailureUnhealthy && kind != sv.FailureConnect {
+			lb.Logger.Printf("Connection to server %s ended: %v", server.URL, err)
+			return
+		}
+		lb.Logger.Printf("Connection failed on server %s: %v", server.URL, err)
+	}
+
+	atomic.AddUint64(&lb.metrics.FailedRequests, 1)
+	lb.Logger.Println(utils.Colorize("No server could take connection from "+conn.RemoteAddr().String(), utils.RED))
+}
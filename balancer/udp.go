@@ -0,0 +1,187 @@
+package balancer
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sv "loadbalancer/server"
+	"loadbalancer/utils"
+)
+
+// maxDatagramSize fits any UDP payload.
+const maxDatagramSize = 64 * 1024
+
+// UDPPolicy controls how datagrams are balanced by ServeUDP.
+type UDPPolicy struct {
+	// PerPacket picks a server for every datagram. Otherwise all datagrams
+	// of a client session go to the same server, as long as it is healthy.
+	PerPacket bool
+
+	// SessionIdle ends a client's session once no datagram has passed
+	// either way for this long. Replies from servers are relayed back to
+	// the client while its session lasts.
+	SessionIdle time.Duration
+
+	// MaxSessions bounds the number of clients served at once, each of
+	// which holds a socket to a server. Datagrams from new clients are
+	// dropped while it is reached. Zero means no limit.
+	MaxSessions int
+}
+
+// DefaultUDPPolicy balances per session, with sessions ending after a
+// minute of silence and up to 10000 of them at once.
+func DefaultUDPPolicy() UDPPolicy {
+	return UDPPolicy{SessionIdle: time.Minute, MaxSessions: 10000}
+}
+
+// udpSession relays the datagrams of one client address.
+type udpSession struct {
+	client net.Addr
+	timer  *time.Timer
+
+	mu        sync.Mutex
+	server    *sv.Server // the session's server, unless balancing per packet
+	upstreams map[*sv.Server]net.Conn
+	closed    bool
+}
+
+// ServeUDP relays datagrams received on pc to servers, and their replies
+// back to the clients, until pc is closed. Each client address gets a
+// session that lasts until it has been idle for UDPPolicy.SessionIdle.
+func (lb *LoadBalancer) ServeUDP(pc net.PacketConn) error {
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, session := range sessions {
+			lb.endSession(session)
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		atomic.AddUint64(&lb.metrics.TotalRequests, 1)
+
+		mu.Lock()
+		session, ok := sessions[client.String()]
+		if !ok && lb.UDPPolicy.MaxSessions > 0 && len(sessions) >= lb.UDPPolicy.MaxSessions {
+			mu.Unlock()
+			atomic.AddUint64(&lb.metrics.FailedRequests, 1)
+			lb.Logger.Println(utils.Colorize("Dropped datagram from "+client.String()+": too many sessions", utils.RED))
+			continue
+		}
+		if !ok {
+			session = &udpSession{client: client, upstreams: make(map[*sv.Server]net.Conn)}
+			session.timer = time.AfterFunc(lb.UDPPolicy.SessionIdle, func() {
+				mu.Lock()
+				if sessions[client.String()] == session {
+					delete(sessions, client.String())
+				}
+				mu.Unlock()
+				lb.endSession(session)
+			})
+			sessions[client.String()] = session
+			atomic.AddInt64(&lb.metrics.ActiveConnections, 1)
+		}
+		mu.Unlock()
+
+		session.timer.Reset(lb.UDPPolicy.SessionIdle)
+		if err := lb.relayDatagram(pc, session, buf[:n]); err != nil {
+			atomic.AddUint64(&lb.metrics.FailedRequests, 1)
+			lb.Logger.Println(utils.Colorize("Dropped datagram from "+client.String()+": "+err.Error(), utils.RED))
+		}
+	}
+}
+
+// relayDatagram sends data from the session's client to a server, opening a
+// socket to that server first if the session has none.
+func (lb *LoadBalancer) relayDatagram(pc net.PacketConn, session *udpSession, data []byte) error {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.closed {
+		return errors.New("session ended")
+	}
+
+	var server *sv.Server
+	if !lb.UDPPolicy.PerPacket && session.server != nil {
+		server = lb.serverByID(serverID(session.server))
+	}
+	if server == nil {
+		server = lb.nextServer(nil)
+		if server == nil {
+			return errors.New("no healthy server")
+		}
+	}
+	if !lb.UDPPolicy.PerPacket && server != session.server {
+		// Release the server the session moves away from, so it can drain
+		if upstream, ok := session.upstreams[session.server]; ok {
+			upstream.Close()
+			delete(session.upstreams, session.server)
+		}
+		session.server = server
+	}
+
+	upstream, ok := session.upstreams[server]
+	if !ok {
+		conn, err := server.DialUDP()
+		if err != nil {
+			return err
+		}
+		upstream = conn
+		session.upstreams[server] = upstream
+		go lb.relayReplies(pc, session, server, upstream)
+	}
+	_, err := upstream.Write(data)
+	return err
+}
+
+// relayReplies sends the datagrams server sends on upstream back to the
+// session's client, until upstream is closed or fails.
+func (lb *LoadBalancer) relayReplies(pc net.PacketConn, session *udpSession, server *sv.Server, upstream net.Conn) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := upstream.Read(buf)
+		if err != nil {
+			// A refused datagram fails the socket; the next one opens a new one
+			session.mu.Lock()
+			if session.upstreams[server] == upstream {
+				delete(session.upstreams, server)
+			}
+			session.mu.Unlock()
+			upstream.Close()
+			return
+		}
+		session.timer.Reset(lb.UDPPolicy.SessionIdle)
+		pc.WriteTo(buf[:n], session.client)
+	}
+}
+
+// endSession closes the sockets of an idle session.
+func (lb *LoadBalancer) endSession(session *udpSession) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.closed {
+		return
+	}
+	session.closed = true
+	session.timer.Stop()
+	for _, upstream := range session.upstreams {
+		upstream.Close()
+	}
+	atomic.AddInt64(&lb.metrics.ActiveConnections, -1)
+}
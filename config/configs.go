@@ -9,14 +9,242 @@ type Config struct {
 	RedisHost     string
 	RedisPort     string
 	RedisPassword string
-	LoadBalancer  struct {
-		Port                       int    `json:"port"`
-		HealthCheckIntervalSeconds int    `json:"health_check_interval_seconds"`
-		Strategy                   string `json:"strategy"` // "least_active" or "round_robin"
-	} `json:"load_balancer"`
-	Servers struct {
-		URLs []string `json:"urls"`
-	} `json:"servers"`
+	LoadBalancer  LoadBalancerConfig           `json:"load_balancer"`
+	Servers       ServersConfig                `json:"servers"`
+	Pools         map[string]PoolConfig        `json:"pools"`         // named backend pools, routed to by Host header
+	DefaultPool   string                       `json:"default_pool"`  // pool for requests no other pool claims, "default" if unset
+	Routes        []RouteConfig                `json:"routes"`        // evaluated in order before host-based pool selection
+	TCPListeners  map[string]TCPListenerConfig `json:"tcp_listeners"` // raw TCP pools, each on its own port
+	UDPListeners  map[string]UDPListenerConfig `json:"udp_listeners"` // UDP pools, each on its own port
+}
+
+// TCPListenerConfig balances raw TCP connections on a port across servers.
+type TCPListenerConfig struct {
+	Port                       int                 `json:"port"`
+	URLs                       []string            `json:"urls"` // "host:port" or "tcp://host:port"
+	Strategy                   string              `json:"strategy"`
+	HealthCheckIntervalSeconds int                 `json:"health_check_interval_seconds"`
+	ConnectTimeoutMs           int                 `json:"connect_timeout_ms"`    // 30000 by default
+	IdleTimeoutSeconds         int                 `json:"idle_timeout_seconds"`  // closes connections idle in both directions, 3600 by default
+	ProxyProtocol              ProxyProtocolConfig `json:"proxy_protocol"`        // read client addresses from PROXY protocol headers
+	SendProxyProtocol          int                 `json:"send_proxy_protocol"`   // 1 or 2 sends servers a PROXY protocol header of that version
+	DrainTimeoutSeconds        int                 `json:"drain_timeout_seconds"` // closes connections still open this long after a server is removed or on shutdown, 30 by default
+}
+
+// UDPListenerConfig balances UDP datagrams on a port across servers.
+type UDPListenerConfig struct {
+	Port               int      `json:"port"`
+	URLs               []string `json:"urls"` // "host:port" or "udp://host:port"
+	Strategy           string   `json:"strategy"`
+	Mode               string   `json:"mode"`                 // "session" (default) keeps a client on one server, "packet" balances every datagram
+	SessionIdleSeconds int      `json:"session_idle_seconds"` // forgets clients idle in both directions, 60 by default
+	MaxSessions        int      `json:"max_sessions"`         // clients served at once, 10000 by default
+}
+
+// RouteConfig sends requests meeting its match conditions to a pool.
+type RouteConfig struct {
+	Name          string         `json:"name"`
+	Pool          string         `json:"pool"`
+	Splits        []SplitConfig  `json:"splits"`         // divides traffic across pools instead of pool
+	StickyCookie  string         `json:"sticky_cookie"`  // keeps users with this cookie on one side of the split
+	StickyHeader  string         `json:"sticky_header"`  // likewise for a header
+	Rollout       *RolloutConfig `json:"rollout"`        // moves the split to a canary step by step, started at boot
+	Mirror        *MirrorConfig  `json:"mirror"`         // copies requests to a shadow pool
+	StripPrefix   bool           `json:"strip_prefix"`   // "/api/users" -> "/users" for path_prefix "/api"
+	PrefixRewrite string         `json:"prefix_rewrite"` // replaces the matched prefix
+	RegexRewrite  string         `json:"regex_rewrite"`  // replaces path_regex matches, may use $1
+	Timeouts      TimeoutsConfig `json:"timeouts"`       // overrides the pool's header, idle-body and total timeouts
+	Deny          bool           `json:"deny"`           // answers matching requests with 403 Forbidden instead
+	MatchConfig
+}
+
+// SplitConfig sends a weighted share of a route's traffic to a pool.
+type SplitConfig struct {
+	Pool   string `json:"pool"`
+	Weight int    `json:"weight"`
+}
+
+// MirrorConfig copies a share of a route's requests to a shadow pool whose
+// responses are discarded.
+type MirrorConfig struct {
+	Pool         string  `json:"pool"`
+	Percent      float64 `json:"percent"`
+	MaxBodyBytes int64   `json:"max_body_bytes"` // larger requests are not mirrored, 1 MiB by default
+}
+
+// RolloutConfig shifts a split route's traffic from a baseline pool to a
+// canary pool, rolling back if the canary does worse.
+type RolloutConfig struct {
+	Baseline             string   `json:"baseline"`
+	Canary               string   `json:"canary"`
+	Steps                []int    `json:"steps"`                   // canary percentages, 1, 5, 25, 100 by default
+	StepIntervalSeconds  int      `json:"step_interval_seconds"`   // shortest time at each step, 300 by default
+	MinRequests          *int     `json:"min_requests"`            // canary requests needed to judge a step, 100 by default
+	MaxErrorRateIncrease *float64 `json:"max_error_rate_increase"` // allowed excess over the baseline's error rate, 0.01 by default
+	MaxP99Ratio          *float64 `json:"max_p99_ratio"`           // allowed multiple of the baseline's p99, 1.5 by default, 0 disables
+}
+
+// MatchConfig lists conditions that must all hold; at least one of Any must
+// hold as well. At most one of Path, PathPrefix and PathRegex may be set.
+type MatchConfig struct {
+	Hosts      []string           `json:"hosts"`
+	Methods    []string           `json:"methods"`
+	Path       string             `json:"path"`
+	PathPrefix string             `json:"path_prefix"`
+	PathRegex  string             `json:"path_regex"`
+	Headers    []ValueMatchConfig `json:"headers"`
+	Query      []ValueMatchConfig `json:"query"`
+	Cookies    []ValueMatchConfig `json:"cookies"`
+	ClientCert []ValueMatchConfig `json:"client_cert"` // "subject", "issuer" or "san" of a verified client certificate
+	Any        []MatchConfig      `json:"any"`
+}
+
+// ValueMatchConfig matches a header, query parameter, cookie or client
+// certificate field by exact value, by regex, or, with neither set, by
+// presence.
+type ValueMatchConfig struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Regex string `json:"regex"`
+}
+
+type LoadBalancerConfig struct {
+	Port          int                 `json:"port"`
+	TLSCertFile   string              `json:"tls_cert_file"` // serve HTTPS (with HTTP/2) when set
+	TLSKeyFile    string              `json:"tls_key_file"`
+	TLS           TLSConfig           `json:"tls"`            // more certificates, chosen by SNI, and TLS settings
+	H2C           bool                `json:"h2c"`            // accept cleartext HTTP/2 from clients (prior knowledge and Upgrade)
+	AdminPort     int                 `json:"admin_port"`     // serves metrics and split weights when set
+	AdminAddress  string              `json:"admin_address"`  // address the admin API listens on, "127.0.0.1" by default
+	AdminToken    string              `json:"admin_token"`    // bearer token the admin API requires when set
+	HTTPPort      int                 `json:"http_port"`      // with TLS on port, also serve plain HTTP here
+	HTTPSRedirect HTTPSRedirectConfig `json:"https_redirect"` // redirect plain HTTP to HTTPS
+	HSTS          HSTSConfig          `json:"hsts"`           // sent with HTTPS responses when max_age_seconds is set
+	ProxyProtocol ProxyProtocolConfig `json:"proxy_protocol"` // read client addresses from PROXY protocol headers on port and http_port
+	UnixSocket    string              `json:"unix_socket"`    // also serve plain HTTP on a Unix socket at this path
+
+	// Settings for the "default" pool built from servers.urls
+	PoolConfig
+}
+
+// HTTPSRedirectConfig makes the plain HTTP listener redirect to HTTPS.
+type HTTPSRedirectConfig struct {
+	Enabled     bool     `json:"enabled"`
+	StatusCode  int      `json:"status_code"`  // 301 or 308 (default)
+	ExemptPaths []string `json:"exempt_paths"` // path prefixes served as usual, "/.well-known/acme-challenge/" by default
+}
+
+// ProxyProtocolConfig accepts HAProxy PROXY protocol headers, v1 or v2, from
+// trusted sources such as an L4 load balancer in front.
+type ProxyProtocolConfig struct {
+	Enabled         bool     `json:"enabled"`
+	TrustedCIDRs    []string `json:"trusted_cidrs"`     // sources that must send a header; others are served as they are
+	HeaderTimeoutMs int      `json:"header_timeout_ms"` // 5000 by default
+}
+
+// HSTSConfig sets the Strict-Transport-Security header.
+type HSTSConfig struct {
+	MaxAgeSeconds     int  `json:"max_age_seconds"`
+	IncludeSubDomains bool `json:"include_subdomains"`
+	Preload           bool `json:"preload"`
+}
+
+// TLSConfig configures the HTTPS listener.
+type TLSConfig struct {
+	Certificates          []CertificateConfig `json:"certificates"`            // chosen by SNI, the first one is the default
+	MinVersion            string              `json:"min_version"`             // "1.0" to "1.3", "1.2" by default
+	CipherSuites          []string            `json:"cipher_suites"`           // TLS 1.2 suites by IANA name, Go's defaults when empty
+	ALPN                  []string            `json:"alpn"`                    // "h2" and "http/1.1" by default
+	ReloadIntervalSeconds int                 `json:"reload_interval_seconds"` // how often certificate files are checked for changes, 10 by default
+	ClientAuth            string              `json:"client_auth"`             // "optional" or "require" to verify client certificates, off when empty
+	ClientCAFile          string              `json:"client_ca_file"`          // PEM bundle of CAs client certificates must chain to
+	ClientCertHeaders     ClientCertHeaders   `json:"client_cert_headers"`     // forward the verified identity to backends
+}
+
+// ClientCertHeaders names the headers carrying a verified client
+// certificate's details to backends; empty names are not sent.
+type ClientCertHeaders struct {
+	Subject     string `json:"subject"` // e.g. "X-Client-Cert-Subject"
+	Issuer      string `json:"issuer"`
+	SAN         string `json:"san"`
+	Fingerprint string `json:"fingerprint"` // SHA-256, in hex
+}
+
+// CertificateConfig names the PEM files of a certificate and its key.
+type CertificateConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// PoolConfig describes a pool of backend servers and how traffic is
+// balanced across them.
+type PoolConfig struct {
+	Hosts                      []string          `json:"hosts"` // Host headers served by the pool, e.g. "api.example.com" or "*.example.com"
+	URLs                       []string          `json:"urls"`
+	HealthCheckIntervalSeconds int               `json:"health_check_interval_seconds"`
+	HealthCheckPath            string            `json:"health_check_path"`            // "/" by default
+	Strategy                   string            `json:"strategy"`                     // "least_active" or "round_robin"
+	FlushIntervalMs            int               `json:"flush_interval_ms"`            // 0 disables periodic flushing, -1 flushes every write
+	StreamContentTypes         []string          `json:"stream_content_types"`         // long-lived streams exempt from timeouts.total_ms, besides SSE and gRPC
+	OutlierFailures            int               `json:"outlier_consecutive_failures"` // eject a server after this many failed calls, 0 disables
+	GRPCRetryableCodes         []int             `json:"grpc_retryable_codes"`         // grpc-status codes a gRPC call may be retried on
+	RetryMethods               []string          `json:"retry_methods"`                // methods that may be retried, idempotent ones by default
+	RetryOn                    []string          `json:"retry_on"`                     // "connect-failure", "timeout" or status codes such as "503"
+	MaxRetries                 *int              `json:"max_retries"`                  // attempts after the first one, 2 by default
+	RetryBudgetPercent         *float64          `json:"retry_budget_percent"`         // retries allowed as a share of recent requests, 20 by default
+	RetryBudgetMinPerSecond    *int              `json:"retry_budget_min_per_second"`  // retries always allowed per second, 10 by default
+	RetryBackoffBaseMs         *int              `json:"retry_backoff_base_ms"`        // first backoff bound, 25 by default
+	RetryBackoffMaxMs          *int              `json:"retry_backoff_max_ms"`         // largest backoff bound, 250 by default
+	RetryBufferBytes           *int              `json:"retry_buffer_bytes"`           // request body bytes kept for retries, 1 MiB by default, 0 for no limit
+	HedgeEnabled               bool              `json:"hedge_enabled"`                // hedge slow idempotent GETs to a second server
+	HedgeDelayMs               int               `json:"hedge_delay_ms"`               // wait before hedging, 0 uses the pool's p95 response time
+	HedgeBudgetPercent         *float64          `json:"hedge_budget_percent"`         // hedges allowed as a share of recent requests, 10 by default
+	Timeouts                   TimeoutsConfig    `json:"timeouts"`
+	DeadlineHeader             string            `json:"deadline_header"` // e.g. "X-Request-Deadline", tells backends the milliseconds left
+	Affinity                   AffinityConfig    `json:"affinity"`
+	UpstreamTLS                UpstreamTLSConfig `json:"upstream_tls"`      // for https:// servers
+	PreserveHost               bool              `json:"preserve_host"`     // send servers the client's Host header instead of their own host
+	HostRewrite                string            `json:"host_rewrite"`      // send servers this Host header instead
+	RewriteRedirects           bool              `json:"rewrite_redirects"` // map Location headers naming a server back to the client's host
+	CookieDomains              map[string]string `json:"cookie_domains"`    // Set-Cookie domains to replace, "" removes the domain
+	CookiePaths                map[string]string `json:"cookie_paths"`      // Set-Cookie path prefixes to replace
+}
+
+// UpstreamTLSConfig configures TLS connections to a pool's servers.
+type UpstreamTLSConfig struct {
+	CAFile             string `json:"ca_file"`   // PEM bundle of CAs trusted instead of the system's
+	CertFile           string `json:"cert_file"` // client certificate presented for mutual TLS
+	KeyFile            string `json:"key_file"`
+	ServerName         string `json:"server_name"`          // SNI and verified name, the URL's host by default
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // accept any server certificate, for lab use only
+}
+
+// AffinityConfig pins clients to the server that first served them.
+type AffinityConfig struct {
+	Mode             string `json:"mode"`               // "cookie" for a balancer-issued cookie, "application" to learn the app's own, off when empty
+	CookieName       string `json:"cookie_name"`        // "lb_affinity_<pool>" by default, required in application mode
+	CookieTTLSeconds int    `json:"cookie_ttl_seconds"` // how long a client stays pinned, 0 for the browser session
+	CookiePath       string `json:"cookie_path"`        // "/" by default
+	CookieDomain     string `json:"cookie_domain"`
+	CookieSecure     bool   `json:"cookie_secure"`
+	CookieHTTPOnly   *bool  `json:"cookie_http_only"`  // true by default
+	CookieSameSite   string `json:"cookie_same_site"`  // "lax" (default), "strict" or "none"
+	CookieSecret     string `json:"cookie_secret"`     // signs cookies; share it between instances, random when empty
+	TableSize        int    `json:"table_size"`        // session cookie values remembered in application mode, 10000 by default
+	TableTTLSeconds  int    `json:"table_ttl_seconds"` // how long an unused value is remembered, 3600 by default
+}
+
+// TimeoutsConfig holds timeouts in milliseconds; zero keeps the default.
+type TimeoutsConfig struct {
+	ConnectMs        int `json:"connect_ms"`
+	TLSHandshakeMs   int `json:"tls_handshake_ms"`
+	ResponseHeaderMs int `json:"response_header_ms"`
+	IdleBodyMs       int `json:"idle_body_ms"`
+	TotalMs          int `json:"total_ms"`
+}
+
+type ServersConfig struct {
+	URLs []string `json:"urls"`
 }
 
 func LoadConfig(filenames ...string) (*Config, error) {
@@ -0,0 +1,75 @@
+package listener
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// ClientCert returns the client certificate of r if it was verified against
+// the listener's client CAs, or nil.
+func ClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// SANs lists the subject alternative names of cert as "DNS:name",
+// "email:address", "URI:uri" and "IP:address".
+func SANs(cert *x509.Certificate) []string {
+	var sans []string
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	return sans
+}
+
+// IdentityHeaders name the request headers that tell backends who a
+// verified client is. Empty names are not sent.
+type IdentityHeaders struct {
+	Subject     string // e.g. "CN=alice,O=Example"
+	Issuer      string
+	SAN         string // every SAN, comma-separated
+	Fingerprint string // the SHA-256 of the certificate, in hex
+}
+
+// ForwardClientCert sets the identity headers from the verified client
+// certificate before passing requests to next. Values sent by clients
+// themselves are always removed, so backends can trust the headers.
+func ForwardClientCert(next http.Handler, headers IdentityHeaders) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		set := map[string]func(*x509.Certificate) string{
+			headers.Subject: func(c *x509.Certificate) string { return c.Subject.String() },
+			headers.Issuer:  func(c *x509.Certificate) string { return c.Issuer.String() },
+			headers.SAN:     func(c *x509.Certificate) string { return strings.Join(SANs(c), ",") },
+			headers.Fingerprint: func(c *x509.Certificate) string {
+				sum := sha256.Sum256(c.Raw)
+				return hex.EncodeToString(sum[:])
+			},
+		}
+		delete(set, "")
+
+		cert := ClientCert(r)
+		for name, value := range set {
+			r.Header.Del(name)
+			if cert != nil {
+				if v := value(cert); v != "" {
+					r.Header.Set(name, v)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
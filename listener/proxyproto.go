@@ -0,0 +1,312 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyV1Length is the longest a v1 header can be, "\r\n" included.
+const maxProxyV1Length = 107
+
+// ProxyHeader is a HAProxy PROXY protocol header, which tells the receiver
+// of a proxied connection whom it is from and whom it was sent to.
+type ProxyHeader struct {
+	Version int // 1 for the text format, 2 for the binary one
+
+	// Source and Destination are the client's address and the address it
+	// connected to. They are nil when the sender did not say, such as for
+	// its own health checks.
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// ReadProxyHeader reads a v1 or v2 header from the start of a connection.
+func ReadProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	if prefix, err := r.Peek(5); err == nil && string(prefix) == "PROXY" {
+		return readProxyV1(r)
+	}
+	if prefix, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+// readProxyV1 reads a header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == maxProxyV1Length {
+			return nil, errors.New("PROXY protocol v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY protocol v1 header: %v", err)
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	header := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header %q", line)
+	}
+	src, err := parseProxyV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	header.Source, header.Destination = src, dst
+	return header, nil
+}
+
+func parseProxyV1Addr(host, port string, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || strings.Contains(host, ":") == v4 {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyV2 reads a binary header. TLVs are skipped.
+func readProxyV2(r *bufio.Reader) (*ProxyHeader, error) {
+	fixed := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol v2 header: %v", err)
+	}
+	versionCommand, family := fixed[12], fixed[13]
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol v2 header: %v", err)
+	}
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", versionCommand>>4)
+	}
+
+	header := &ProxyHeader{Version: 2}
+	switch versionCommand & 0xf {
+	case 0: // LOCAL: the sender's own connection
+		return header, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 command %d", versionCommand&0xf)
+	}
+
+	var size int
+	switch family >> 4 {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default: // unspecified or a Unix socket, for which nothing is known
+		return header, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, errors.New("PROXY protocol v2 addresses truncated")
+	}
+	ports := body[2*size:]
+	header.Source = &net.TCPAddr{IP: net.IP(body[:size]), Port: int(binary.BigEndian.Uint16(ports))}
+	header.Destination = &net.TCPAddr{IP: net.IP(body[size : 2*size]), Port: int(binary.BigEndian.Uint16(ports[2:]))}
+	return header, nil
+}
+
+// Marshal encodes h. Without TCP addresses for both ends, it says that the
+// addresses are unknown.
+func (h ProxyHeader) Marshal() ([]byte, error) {
+	src, srcOK := h.Source.(*net.TCPAddr)
+	dst, dstOK := h.Destination.(*net.TCPAddr)
+	known := srcOK && dstOK
+	v4 := known && src.IP.To4() != nil && dst.IP.To4() != nil
+
+	switch h.Version {
+	case 1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		family := "TCP6"
+		if v4 {
+			family = "TCP4"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, proxyV1IP(src.IP, v4), proxyV1IP(dst.IP, v4), src.Port, dst.Port), nil
+	case 2:
+		buf := append([]byte(nil), proxyV2Signature...)
+		switch {
+		case !known:
+			return append(buf, 0x21, 0x00, 0, 0), nil
+		case v4:
+			buf = append(buf, 0x21, 0x11, 0, 12)
+			buf = append(append(buf, src.IP.To4()...), dst.IP.To4()...)
+		default:
+			buf = append(buf, 0x21, 0x21, 0, 36)
+			buf = append(append(buf, src.IP.To16()...), dst.IP.To16()...)
+		}
+		buf = binary.BigEndian.AppendUint16(buf, uint16(src.Port))
+		return binary.BigEndian.AppendUint16(buf, uint16(dst.Port)), nil
+	}
+	return nil, fmt.Errorf("unknown PROXY protocol version %d", h.Version)
+}
+
+// proxyV1IP formats ip for a v1 header. IPv4 addresses in a TCP6 header,
+// when the two ends differ in family, are written as IPv4-mapped ones.
+func proxyV1IP(ip net.IP, v4 bool) string {
+	if !v4 && ip.To4() != nil {
+		return "::ffff:" + ip.To4().String()
+	}
+	return ip.String()
+}
+
+// ProxyProtocol accepts PROXY protocol headers from trusted sources, such as
+// an L4 load balancer in front, so the real client addresses are known.
+type ProxyProtocol struct {
+	// Trusted lists the networks that send headers. Connections from them
+	// must start with one; connections from anywhere else are taken as
+	// they are.
+	Trusted []*net.IPNet
+
+	// HeaderTimeout bounds the wait for a header.
+	HeaderTimeout time.Duration
+}
+
+// DefaultProxyProtocol trusts no one and waits up to 5 seconds for headers.
+func DefaultProxyProtocol() ProxyProtocol {
+	return ProxyProtocol{HeaderTimeout: 5 * time.Second}
+}
+
+// ParseCIDRs parses networks such as "10.0.0.0/8". Plain addresses stand for
+// themselves.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Listen wraps ln so that connections from trusted sources report the
+// addresses in their PROXY protocol header as their own. The header is read
+// on the connection's first use, not in Accept, so a slow sender does not
+// hold up other connections. A connection without a valid header fails.
+func (p ProxyProtocol) Listen(ln net.Listener) net.Listener {
+	return &proxyListener{Listener: ln, policy: p}
+}
+
+type proxyListener struct {
+	net.Listener
+	policy ProxyProtocol
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil || !l.policy.trusts(conn.RemoteAddr()) {
+		return conn, err
+	}
+	return &proxyConn{Conn: conn, timeout: l.policy.HeaderTimeout}, nil
+}
+
+func (p ProxyProtocol) trusts(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range p.Trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn reads the PROXY protocol header of a connection before anything
+// else.
+type proxyConn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	reader *bufio.Reader
+	header *ProxyHeader
+	err    error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.reader = bufio.NewReader(c.Conn)
+		c.header, c.err = ReadProxyHeader(c.reader)
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client's address from the header, or the sender's
+// own when the header carries none.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to, from the header.
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite half-closes the connection where supported, for TCP proxying.
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
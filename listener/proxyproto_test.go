@@ -0,0 +1,137 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	v4dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+
+	tests := []struct {
+		name     string
+		header   ProxyHeader
+		v1       string
+		src, dst string
+	}{
+		{name: "IPv4", header: ProxyHeader{Source: v4, Destination: v4dst}, v1: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", src: "192.0.2.1:56324", dst: "198.51.100.1:443"},
+		{name: "IPv6", header: ProxyHeader{Source: v6, Destination: v4dst}, v1: "PROXY TCP6 2001:db8::1 ::ffff:198.51.100.1 56324 443\r\n", src: "[2001:db8::1]:56324", dst: "198.51.100.1:443"},
+		{name: "unknown", header: ProxyHeader{Source: &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, Destination: v4dst}, v1: "PROXY UNKNOWN\r\n"},
+	}
+	for _, tc := range tests {
+		for _, version := range []int{1, 2} {
+			tc.header.Version = version
+			b, err := tc.header.Marshal()
+			if err != nil {
+				t.Fatalf("%s v%d: failed to marshal: %v", tc.name, version, err)
+			}
+			if version == 1 && string(b) != tc.v1 {
+				t.Errorf("%s: expected %q, got %q", tc.name, tc.v1, b)
+			}
+
+			r := bufio.NewReader(io.MultiReader(bytes.NewReader(b), bytes.NewReader([]byte("GET /"))))
+			got, err := ReadProxyHeader(r)
+			if err != nil {
+				t.Fatalf("%s v%d: failed to read: %v", tc.name, version, err)
+			}
+			if got.Version != version || addrString(got.Source) != tc.src || addrString(got.Destination) != tc.dst {
+				t.Errorf("%s v%d: expected %s -> %s, got %+v", tc.name, version, tc.src, tc.dst, got)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "GET /" {
+				t.Errorf("%s v%d: expected the data after the header to be left, got %q", tc.name, version, rest)
+			}
+		}
+	}
+
+	for _, malformed := range []string{"GET / HTTP/1.1\r\n", "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "PROXY TCP4 2001:db8::1 198.51.100.1 1 2\r\n", "PROXY TCP4 " + string(bytes.Repeat([]byte("1"), 200))} {
+		if _, err := ReadProxyHeader(bufio.NewReader(bytes.NewReader([]byte(malformed)))); err == nil {
+			t.Errorf("expected %q to be rejected", malformed)
+		}
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestProxyProtocolListen(t *testing.T) {
+	trusted, err := ParseCIDRs([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("failed to parse CIDRs: %v", err)
+	}
+	policy := DefaultProxyProtocol()
+	policy.HeaderTimeout = 100 * time.Millisecond
+	policy.Trusted = trusted
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	proxied := policy.Listen(ln)
+
+	// accept sends data from a new connection and returns the accepted end
+	accept := func(data string) net.Conn {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		t.Cleanup(func() { client.Close() })
+		io.WriteString(client, data)
+		conn, err := proxied.Accept()
+		if err != nil {
+			t.Fatalf("failed to accept: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	conn := accept("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello")
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("expected the client address from the header, got %s", got)
+	}
+	if got := conn.LocalAddr().String(); got != "198.51.100.1:443" {
+		t.Errorf("expected the destination address from the header, got %s", got)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("expected the data after the header, got %q, %v", buf, err)
+	}
+
+	// A LOCAL header, as sent for health checks, keeps the sender's address
+	local, _ := ProxyHeader{Version: 2}.Marshal()
+	conn = accept(string(local))
+	if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Errorf("expected the sender's own address, got %s", conn.RemoteAddr())
+	}
+
+	// Trusted sources must send a header, in time
+	conn = accept("GET / HTTP/1.1\r\n\r\n")
+	if _, err := conn.Read(buf); err == nil {
+		t.Error("expected a connection without a header to fail")
+	}
+	conn = accept("")
+	if _, err := conn.Read(buf); err == nil {
+		t.Error("expected a connection without a header to time out")
+	}
+
+	// Other sources are taken as they are
+	policy.Trusted, _ = ParseCIDRs([]string{"10.0.0.0/8"})
+	proxied = policy.Listen(ln)
+	conn = accept("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")
+	if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Errorf("expected an untrusted header to be ignored, got %s", conn.RemoteAddr())
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "PROXY" {
+		t.Errorf("expected an untrusted header to be passed on as data, got %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,119 @@
+package listener
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redirect sends plain HTTP clients to HTTPS.
+type Redirect struct {
+	// Status is http.StatusMovedPermanently or http.StatusPermanentRedirect;
+	// the latter keeps the method and body of non-GET requests.
+	Status int
+
+	// HTTPSPort is the port of the HTTPS listener, left out of redirects
+	// when it is 443.
+	HTTPSPort int
+
+	// Exempt lists path prefixes that are served over plain HTTP as usual,
+	// such as "/.well-known/acme-challenge/".
+	Exempt []string
+}
+
+// DefaultRedirect answers with 308 and exempts ACME HTTP-01 challenges.
+func DefaultRedirect() Redirect {
+	return Redirect{
+		Status:    http.StatusPermanentRedirect,
+		HTTPSPort: 443,
+		Exempt:    []string{"/.well-known/acme-challenge/"},
+	}
+}
+
+// RedirectToHTTPS redirects requests to the same URL over HTTPS, except for
+// exempt paths, which go to next.
+func RedirectToHTTPS(next http.Handler, redirect Redirect) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range redirect.Exempt {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]" // an IPv6 address
+		}
+		if redirect.HTTPSPort != 0 && redirect.HTTPSPort != 443 {
+			host += ":" + strconv.Itoa(redirect.HTTPSPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), redirect.Status)
+	})
+}
+
+// HSTS is a Strict-Transport-Security policy.
+type HSTS struct {
+	MaxAge            time.Duration
+	IncludeSubDomains bool
+	Preload           bool
+}
+
+// Header returns the Strict-Transport-Security header value.
+func (h HSTS) Header() string {
+	value := "max-age=" + strconv.FormatInt(int64(h.MaxAge/time.Second), 10)
+	if h.IncludeSubDomains {
+		value += "; includeSubDomains"
+	}
+	if h.Preload {
+		value += "; preload"
+	}
+	return value
+}
+
+// AddHSTS adds the Strict-Transport-Security header to responses sent over
+// TLS, unless the backend set its own.
+func AddHSTS(next http.Handler, hsts HSTS) http.Handler {
+	header := hsts.Header()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w = &hstsWriter{ResponseWriter: w, header: header}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hstsWriter sets the HSTS header when the response header is written.
+type hstsWriter struct {
+	http.ResponseWriter
+	header      string
+	wroteHeader bool
+}
+
+func (w *hstsWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if w.Header().Get("Strict-Transport-Security") == "" {
+			w.Header().Set("Strict-Transport-Security", w.header)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *hstsWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, so
+// streamed responses can still be flushed.
+func (w *hstsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
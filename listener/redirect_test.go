@@ -0,0 +1,87 @@
+package listener
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	})
+	redirect := DefaultRedirect()
+
+	tests := []struct {
+		name     string
+		target   string
+		host     string
+		port     int
+		status   int
+		location string
+	}{
+		{name: "default port", target: "/a/b?c=d", host: "example.com:80", port: 443, status: http.StatusPermanentRedirect, location: "https://example.com/a/b?c=d"},
+		{name: "other port", target: "/", host: "example.com", port: 8443, status: http.StatusPermanentRedirect, location: "https://example.com:8443/"},
+		{name: "IPv6", target: "/", host: "[::1]:8080", port: 443, status: http.StatusPermanentRedirect, location: "https://[::1]/"},
+		{name: "ACME challenge", target: "/.well-known/acme-challenge/token", host: "example.com", port: 443, status: http.StatusOK},
+	}
+	for _, tc := range tests {
+		redirect.HTTPSPort = tc.port
+		req := httptest.NewRequest(http.MethodPost, tc.target, nil)
+		req.Host = tc.host
+		w := httptest.NewRecorder()
+		RedirectToHTTPS(backend, redirect).ServeHTTP(w, req)
+		if w.Code != tc.status || w.Header().Get("Location") != tc.location {
+			t.Errorf("%s: expected %d %q, got %d %q", tc.name, tc.status, tc.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	redirect.Status = http.StatusMovedPermanently
+	w := httptest.NewRecorder()
+	RedirectToHTTPS(backend, redirect).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusMovedPermanently {
+		t.Errorf("expected status 301, got %d", w.Code)
+	}
+}
+
+func TestAddHSTS(t *testing.T) {
+	hsts := HSTS{MaxAge: 365 * 24 * time.Hour, IncludeSubDomains: true, Preload: true}
+	if got, want := hsts.Header(), "max-age=31536000; includeSubDomains; preload"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	own := false
+	handler := AddHSTS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if own {
+			w.Header().Set("Strict-Transport-Security", "max-age=60")
+		}
+		io.WriteString(w, "ok")
+		http.NewResponseController(w).Flush()
+	}), HSTS{MaxAge: time.Hour})
+
+	serve := func(secure bool) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if secure {
+			req.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if !w.Flushed {
+			t.Error("expected the response to be flushable through the HSTS writer")
+		}
+		return w.Header().Get("Strict-Transport-Security")
+	}
+	if got := serve(true); got != "max-age=3600" {
+		t.Errorf("expected HSTS over TLS, got %q", got)
+	}
+	if got := serve(false); got != "" {
+		t.Errorf("expected no HSTS over plain HTTP, got %q", got)
+	}
+	own = true
+	if got := serve(true); got != "max-age=60" {
+		t.Errorf("expected the backend's own policy to be kept, got %q", got)
+	}
+}
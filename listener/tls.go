@@ -0,0 +1,265 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"loadbalancer/utils"
+)
+
+// KeyPair names the PEM files of a certificate and its private key.
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Certificates serves the certificate matching each client's SNI server
+// name and reloads certificates when their files change. The first key pair
+// is served to clients that match no certificate or send no server name.
+type Certificates struct {
+	pairs  []KeyPair
+	logger *log.Logger
+
+	mu       sync.RWMutex
+	certs    []*tls.Certificate
+	byName   map[string]*tls.Certificate
+	modTimes []time.Time
+}
+
+// LoadCertificates loads every key pair, failing if any cannot be loaded.
+func LoadCertificates(logger *log.Logger, pairs []KeyPair) (*Certificates, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("no TLS certificates configured")
+	}
+	c := &Certificates{
+		pairs:    pairs,
+		logger:   logger,
+		certs:    make([]*tls.Certificate, len(pairs)),
+		modTimes: make([]time.Time, len(pairs)),
+	}
+	for i, pair := range pairs {
+		cert, modTime, err := loadKeyPair(pair)
+		if err != nil {
+			return nil, err
+		}
+		c.certs[i] = cert
+		c.modTimes[i] = modTime
+	}
+	c.index()
+	return c, nil
+}
+
+// loadKeyPair loads pair along with the latest modification time of its
+// files.
+func loadKeyPair(pair KeyPair) (*tls.Certificate, time.Time, error) {
+	modTime, err := latestModTime(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to load certificate %s: %v", pair.CertFile, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to parse certificate %s: %v", pair.CertFile, err)
+		}
+	}
+	return &cert, modTime, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// index maps the names each certificate is valid for to the certificate.
+// Earlier certificates win when names overlap. c.mu must be held for
+// writing, or c not yet shared.
+func (c *Certificates) index() {
+	c.byName = make(map[string]*tls.Certificate)
+	for _, cert := range c.certs {
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := c.byName[name]; !ok {
+				c.byName[name] = cert
+			}
+		}
+	}
+}
+
+// GetCertificate picks the certificate for a handshake: an exact match of
+// the server name, then a wildcard match, then the default certificate. It
+// is meant for tls.Config.GetCertificate.
+func (c *Certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := c.byName[name]; ok {
+		return cert, nil
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := c.byName["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+	return c.certs[0], nil
+}
+
+// Reload reloads the key pairs whose files changed since they were loaded.
+// A pair that fails to load keeps its previous certificate. Handshakes in
+// progress and established connections are not affected.
+func (c *Certificates) Reload() {
+	for i, pair := range c.pairs {
+		c.mu.RLock()
+		loaded := c.modTimes[i]
+		c.mu.RUnlock()
+
+		modTime, err := latestModTime(pair.CertFile, pair.KeyFile)
+		if err != nil || !modTime.After(loaded) {
+			continue
+		}
+		cert, modTime, err := loadKeyPair(pair)
+		if err != nil {
+			c.logger.Println(utils.Colorize(fmt.Sprintf("Keeping previous certificate: %v", err), utils.RED))
+			continue
+		}
+
+		c.mu.Lock()
+		c.certs[i] = cert
+		c.modTimes[i] = modTime
+		c.index()
+		c.mu.Unlock()
+		c.logger.Println(utils.Colorize("Reloaded certificate "+pair.CertFile, utils.GREEN))
+	}
+}
+
+// WatchFiles checks the certificate files for changes every interval and
+// reloads the ones that changed.
+func (c *Certificates) WatchFiles(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			c.Reload()
+		}
+	}()
+}
+
+// Options are the TLS settings of a listener.
+type Options struct {
+	// MinVersion is the oldest TLS version accepted, such as tls.VersionTLS12.
+	MinVersion uint16
+
+	// CipherSuites restricts the cipher suites of TLS 1.2 and older. Go's
+	// defaults are used when empty; TLS 1.3 suites are not configurable.
+	CipherSuites []uint16
+
+	// NextProtos lists the ALPN protocols offered, in order of preference.
+	NextProtos []string
+
+	// ClientAuth asks clients for certificates, which are verified against
+	// ClientCAs; tls.NoClientCert by default.
+	ClientAuth tls.ClientAuthType
+	ClientCAs  *x509.CertPool
+}
+
+// DefaultOptions accepts TLS 1.2 and later and offers HTTP/2 over HTTP/1.1.
+func DefaultOptions() Options {
+	return Options{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+}
+
+// NewTLSConfig returns a server TLS configuration serving certs.
+func NewTLSConfig(certs *Certificates, opts Options) *tls.Config {
+	return &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     opts.MinVersion,
+		CipherSuites:   opts.CipherSuites,
+		NextProtos:     opts.NextProtos,
+		ClientAuth:     opts.ClientAuth,
+		ClientCAs:      opts.ClientCAs,
+	}
+}
+
+// ParseVersion parses a TLS version such as "1.2".
+func ParseVersion(version string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(version), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", version)
+}
+
+// ParseClientAuth parses a client certificate policy: "none", "optional" to
+// verify certificates clients choose to send, or "require".
+func ParseClientAuth(policy string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(policy) {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return 0, fmt.Errorf("unknown client_auth %q", policy)
+}
+
+// ParseCipherSuites parses cipher suites by their IANA names, such as
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". Insecure suites and TLS 1.3
+// suites, which cannot be configured, are rejected.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		suite := findCipherSuite(name)
+		switch {
+		case suite == nil:
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		case suite.Insecure:
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		case len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13:
+			return nil, fmt.Errorf("cipher suite %s is a TLS 1.3 suite, which cannot be configured", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+func findCipherSuite(name string) *tls.CipherSuite {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, suite := range suites {
+			if suite.Name == name {
+				return suite
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"loadbalancer/internal/testcert"
+)
+
+// writeKeyPair writes a self-signed certificate for names, and its key, to
+// dir, returning their paths.
+func writeKeyPair(t *testing.T, dir, file, commonName string, names ...string) KeyPair {
+	t.Helper()
+	cert := testcert.New(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		DNSNames:    names,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	certFile, keyFile := testcert.Write(t, cert, dir, file)
+	return KeyPair{CertFile: certFile, KeyFile: keyFile}
+}
+
+func TestCertificatesBySNI(t *testing.T) {
+	dir := t.TempDir()
+	certs, err := LoadCertificates(log.New(io.Discard, "", 0), []KeyPair{
+		writeKeyPair(t, dir, "default", "default", "default.example.com"),
+		writeKeyPair(t, dir, "api", "api", "api.example.com"),
+		writeKeyPair(t, dir, "wildcard", "wildcard", "*.example.org"),
+		writeKeyPair(t, dir, "legacy", "legacy.example.net"),
+	})
+	if err != nil {
+		t.Fatalf("failed to load certificates: %v", err)
+	}
+
+	tests := map[string]string{
+		"api.example.com":     "api",
+		"API.Example.com.":    "api",
+		"www.example.org":     "wildcard",
+		"a.b.example.org":     "default",
+		"legacy.example.net":  "legacy.example.net",
+		"unknown.example.com": "default",
+		"":                    "default",
+	}
+	for serverName, want := range tests {
+		cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatalf("%q: unexpected error %v", serverName, err)
+		}
+		if got := cert.Leaf.Subject.CommonName; got != want {
+			t.Errorf("%q: expected certificate %s, got %s", serverName, want, got)
+		}
+	}
+}
+
+func TestLoadCertificatesErrors(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	if _, err := LoadCertificates(logger, nil); err == nil {
+		t.Error("expected an error without certificates")
+	}
+	if _, err := LoadCertificates(logger, []KeyPair{{CertFile: "missing.crt", KeyFile: "missing.key"}}); err == nil {
+		t.Error("expected an error for missing files")
+	}
+}
+
+func TestCertificatesReload(t *testing.T) {
+	dir := t.TempDir()
+	pair := writeKeyPair(t, dir, "site", "old", "localhost")
+	certs, err := LoadCertificates(log.New(io.Discard, "", 0), []KeyPair{pair})
+	if err != nil {
+		t.Fatalf("failed to load certificates: %v", err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = NewTLSConfig(certs, DefaultOptions())
+	srv.StartTLS()
+	defer srv.Close()
+
+	// Connections established before the reload keep working
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"}}
+	client := &http.Client{Transport: transport}
+	served := func(client *http.Client) string {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if got := served(client); got != "old" {
+		t.Fatalf("expected the old certificate, got %s", got)
+	}
+
+	// An unchanged file is not reloaded, a changed one is
+	certs.Reload()
+	later := time.Now().Add(time.Second)
+	writeKeyPair(t, dir, "site", "new", "localhost")
+	os.Chtimes(pair.CertFile, later, later)
+	certs.Reload()
+
+	if got := served(client); got != "old" {
+		t.Errorf("expected the open connection to be kept, got certificate %s", got)
+	}
+	fresh := &http.Client{Transport: &http.Transport{TLSClientConfig: transport.TLSClientConfig}}
+	if got := served(fresh); got != "new" {
+		t.Errorf("expected new connections to get the reloaded certificate, got %s", got)
+	}
+
+	// A broken file keeps the previous certificate
+	os.WriteFile(pair.KeyFile, []byte("garbage"), 0o600)
+	os.Chtimes(pair.KeyFile, later.Add(time.Second), later.Add(time.Second))
+	certs.Reload()
+	fresh = &http.Client{Transport: &http.Transport{TLSClientConfig: transport.TLSClientConfig}}
+	if got := served(fresh); got != "new" {
+		t.Errorf("expected a broken file to keep the current certificate, got %s", got)
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	if v, err := ParseVersion("1.3"); err != nil || v != tls.VersionTLS13 {
+		t.Errorf("expected TLS 1.3, got %x, %v", v, err)
+	}
+	if _, err := ParseVersion("2.0"); err == nil {
+		t.Error("expected an error for an unknown version")
+	}
+
+	ids, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"})
+	if err != nil || len(ids) != 1 || ids[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("unexpected cipher suites %v, %v", ids, err)
+	}
+	for _, name := range []string{"TLS_NOPE", "TLS_RSA_WITH_RC4_128_SHA", "TLS_AES_128_GCM_SHA256"} {
+		if _, err := ParseCipherSuites([]string{name}); err == nil {
+			t.Errorf("expected %s to be rejected", name)
+		}
+	}
+}
+
+// clientCertificate returns a self-signed client certificate with a URI SAN.
+func clientCertificate(t *testing.T, commonName string) tls.Certificate {
+	t.Helper()
+	spiffe, _ := url.Parse("spiffe://example.com/" + commonName)
+	return testcert.New(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName, Organization: []string{"Example"}},
+		URIs:        []*url.URL{spiffe},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+func TestForwardClientCert(t *testing.T) {
+	dir := t.TempDir()
+	logger := log.New(io.Discard, "", 0)
+	certs, err := LoadCertificates(logger, []KeyPair{writeKeyPair(t, dir, "site", "site", "localhost")})
+	if err != nil {
+		t.Fatalf("failed to load certificates: %v", err)
+	}
+	trusted := clientCertificate(t, "alice")
+	untrusted := clientCertificate(t, "mallory")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(trusted.Leaf)
+
+	headers := IdentityHeaders{Subject: "X-Client-Cert-Subject", SAN: "X-Client-Cert-SAN", Fingerprint: "X-Client-Cert-Sha256"}
+	srv := httptest.NewUnstartedServer(ForwardClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%d", r.Header.Get(headers.Subject), r.Header.Get(headers.SAN), len(r.Header.Get(headers.Fingerprint)))
+	}), headers))
+	opts := DefaultOptions()
+	opts.ClientAuth, _ = ParseClientAuth("optional")
+	opts.ClientCAs = clientCAs
+	srv.TLS = NewTLSConfig(certs, opts)
+	srv.Config.ErrorLog = logger
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(cert *tls.Certificate) (string, error) {
+		tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			// Present the certificate even if its CA is not one the server asks for
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return cert, nil }
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		req.Header.Set(headers.Subject, "CN=spoofed")
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), nil
+	}
+
+	got, err := get(&trusted)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if want := "CN=alice,O=Example|URI:spiffe://example.com/alice|64"; got != want {
+		t.Errorf("expected identity headers %q, got %q", want, got)
+	}
+	if got, err := get(nil); err != nil || got != "||0" {
+		t.Errorf("expected clients without a certificate to get no identity, got %q, %v", got, err)
+	}
+	if _, err := get(&untrusted); err == nil {
+		t.Error("expected a certificate from an unknown CA to be rejected")
+	}
+
+	if _, err := ParseClientAuth("sometimes"); err == nil {
+		t.Error("expected an unknown client_auth to be rejected")
+	}
+}
@@ -1,18 +1,25 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"time"
 
 	"loadbalancer/balancer"
 	"loadbalancer/config"
+	"loadbalancer/listener"
 	"loadbalancer/utils"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func main() {
@@ -25,23 +32,77 @@ func main() {
 		logger.Fatalf("Error loading configuration: %v\n", err)
 	}
 
-	// Create load balancer with strategy from config
-	lb := balancer.NewLoadBalancer(logger, config.LoadBalancer.Strategy)
+	// Create a load balancer per pool and route hosts to them
+	rt, err := newRouter(logger, config)
+	if err != nil {
+		logger.Fatalf("Error setting up pools: %v\n", err)
+	}
 
-	// Add servers from configuration
-	for _, url := range config.Servers.URLs {
-		lb.AddServer(url)
+	// Serve metrics and split weights on the admin port, by default to this
+	// host only, as the API can change where traffic goes
+	if adminPort := config.LoadBalancer.AdminPort; adminPort > 0 {
+		adminAddr := net.JoinHostPort(config.LoadBalancer.AdminAddress, fmt.Sprint(adminPort))
+		if config.LoadBalancer.AdminAddress == "" {
+			adminAddr = net.JoinHostPort("127.0.0.1", fmt.Sprint(adminPort))
+		}
+		adminHandler := newAdminHandler(rt, config.LoadBalancer.AdminToken)
+		go func() {
+			logger.Println(utils.Colorize("Admin API is running on "+adminAddr, utils.GREEN))
+			if err := http.ListenAndServe(adminAddr, adminHandler); err != nil {
+				logger.Fatalf("Admin API failed: %v\n", err)
+			}
+		}()
 	}
 
-	// Start health checks
-	healthCheckInterval := time.Duration(config.LoadBalancer.HealthCheckIntervalSeconds) * time.Second
-	lb.StartHealthChecks(healthCheckInterval)
+	// Proxy raw TCP connections on their own ports
+	var tcpListeners []net.Listener
+	var tcpPools []*balancer.LoadBalancer
+	for name, tcpCfg := range config.TCPListeners {
+		lb, err := newTCPPool(logger, name, tcpCfg)
+		if err != nil {
+			logger.Fatalf("Error setting up TCP listeners: %v\n", err)
+		}
+		ln, err := listen(fmt.Sprintf(":%d", tcpCfg.Port), tcpCfg.ProxyProtocol)
+		if err != nil {
+			logger.Fatalf("Error setting up TCP listeners: %v\n", err)
+		}
+		tcpListeners = append(tcpListeners, ln)
+		tcpPools = append(tcpPools, lb)
+		go func() {
+			logger.Println(utils.Colorize(fmt.Sprintf("TCP listener %s is running on port %d", name, tcpCfg.Port), utils.GREEN))
+			if err := lb.ServeTCP(ln); err != nil {
+				logger.Fatalf("TCP listener %s failed: %v\n", name, err)
+			}
+		}()
+	}
 
-	// Add metrics endpoint
-	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		metrics := lb.GetMetrics()
-		json.NewEncoder(w).Encode(metrics)
-	})
+	// Relay UDP datagrams on their own ports
+	var udpConns []net.PacketConn
+	for name, udpCfg := range config.UDPListeners {
+		lb, err := newUDPPool(logger, name, udpCfg)
+		if err != nil {
+			logger.Fatalf("Error setting up UDP listeners: %v\n", err)
+		}
+		pc, err := net.ListenPacket("udp", fmt.Sprintf(":%d", udpCfg.Port))
+		if err != nil {
+			logger.Fatalf("Error setting up UDP listeners: %v\n", err)
+		}
+		udpConns = append(udpConns, pc)
+		go func() {
+			logger.Println(utils.Colorize(fmt.Sprintf("UDP listener %s is running on port %d", name, udpCfg.Port), utils.GREEN))
+			if err := lb.ServeUDP(pc); err != nil {
+				logger.Fatalf("UDP listener %s failed: %v\n", name, err)
+			}
+		}()
+	}
+
+	// Listen on a Unix socket as well, for sidecars
+	var unixLn net.Listener
+	if socket := config.LoadBalancer.UnixSocket; socket != "" {
+		if unixLn, err = listenUnix(socket); err != nil {
+			logger.Fatalf("Error setting up the Unix socket listener: %v\n", err)
+		}
+	}
 
 	// Setup graceful shutdown
 	stop := make(chan os.Signal, 1)
@@ -49,14 +110,234 @@ func main() {
 
 	go func() {
 		<-stop
-		lb.GracefulShutdown()
+		for _, ln := range tcpListeners {
+			ln.Close()
+		}
+		for _, pc := range udpConns {
+			pc.Close()
+		}
+		if unixLn != nil {
+			unixLn.Close()
+		}
+		rt.GracefulShutdown()
+		for _, lb := range tcpPools {
+			lb.GracefulShutdown()
+		}
 		os.Exit(0)
 	}()
 
 	// Start the load balancer
+	tlsConfig, err := newTLSConfig(logger, config.LoadBalancer)
+	if err != nil {
+		logger.Fatalf("Error setting up TLS: %v\n", err)
+	}
 	port := config.LoadBalancer.Port
+	var handler http.Handler = rt
+	if headers := listener.IdentityHeaders(config.LoadBalancer.TLS.ClientCertHeaders); headers != (listener.IdentityHeaders{}) {
+		handler = listener.ForwardClientCert(rt, headers)
+	}
+
+	// Serve plain HTTP next to HTTPS, redirecting if asked to
+	if httpPort := config.LoadBalancer.HTTPPort; httpPort > 0 {
+		plain, err := plainHTTPHandler(handler, config.LoadBalancer, tlsConfig != nil)
+		if err != nil {
+			logger.Fatalf("Error setting up the HTTP listener: %v\n", err)
+		}
+		plainSrv, err := newHTTPServer(fmt.Sprintf(":%d", httpPort), plain, config.LoadBalancer, nil)
+		if err != nil {
+			logger.Fatalf("Error setting up the HTTP listener: %v\n", err)
+		}
+		plainLn, err := listen(plainSrv.Addr, config.LoadBalancer.ProxyProtocol)
+		if err != nil {
+			logger.Fatalf("Error setting up the HTTP listener: %v\n", err)
+		}
+		go func() {
+			logger.Println(utils.Colorize(fmt.Sprintf("HTTP listener is running on port %d", httpPort), utils.GREEN))
+			if err := plainSrv.Serve(plainLn); err != nil {
+				logger.Fatalf("HTTP listener failed: %v\n", err)
+			}
+		}()
+	}
+	if hsts := config.LoadBalancer.HSTS; hsts.MaxAgeSeconds > 0 {
+		handler = listener.AddHSTS(handler, listener.HSTS{
+			MaxAge:            time.Duration(hsts.MaxAgeSeconds) * time.Second,
+			IncludeSubDomains: hsts.IncludeSubDomains,
+			Preload:           hsts.Preload,
+		})
+	}
+
+	if unixLn != nil {
+		unixSrv, err := newHTTPServer("", handler, config.LoadBalancer, nil)
+		if err != nil {
+			logger.Fatalf("Error setting up the Unix socket listener: %v\n", err)
+		}
+		go func() {
+			logger.Println(utils.Colorize("Unix socket listener is running on "+unixLn.Addr().String(), utils.GREEN))
+			if err := unixSrv.Serve(unixLn); err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.Fatalf("Unix socket listener failed: %v\n", err)
+			}
+		}()
+	}
+
+	srv, err := newHTTPServer(fmt.Sprintf(":%d", port), handler, config.LoadBalancer, tlsConfig)
+	if err != nil {
+		logger.Fatalf("Error setting up the listener: %v\n", err)
+	}
+	ln, err := listen(srv.Addr, config.LoadBalancer.ProxyProtocol)
+	if err != nil {
+		logger.Fatalf("Error setting up the listener: %v\n", err)
+	}
 	logger.Println(utils.Colorize(fmt.Sprintf("Load balancer is running on port %d", port), utils.GREEN))
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), lb); err != nil {
+	if tlsConfig != nil {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != nil {
 		logger.Fatalf("Load balancer failed: %v\n", err)
 	}
 }
+
+// newHTTPServer builds the front-end server. HTTP/2 is negotiated over TLS
+// unless ALPN leaves out "h2", and cleartext HTTP/2 is accepted as well when
+// h2c is enabled.
+func newHTTPServer(addr string, handler http.Handler, cfg config.LoadBalancerConfig, tlsConfig *tls.Config) (*http.Server, error) {
+	h2s := &http2.Server{}
+	if cfg.H2C {
+		handler = h2c.NewHandler(handler, h2s)
+	}
+	srv := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+	if tlsConfig != nil && !slices.Contains(tlsConfig.NextProtos, "h2") {
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		return srv, nil
+	}
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+// listen listens for TCP connections on addr. With the PROXY protocol
+// enabled, connections from trusted sources report the client addresses
+// from their headers.
+func listen(addr string, cfg config.ProxyProtocolConfig) (net.Listener, error) {
+	if !cfg.Enabled {
+		return net.Listen("tcp", addr)
+	}
+	policy := listener.DefaultProxyProtocol()
+	trusted, err := listener.ParseCIDRs(cfg.TrustedCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("proxy_protocol: %v", err)
+	}
+	if len(trusted) == 0 {
+		return nil, errors.New("proxy_protocol needs trusted_cidrs")
+	}
+	policy.Trusted = trusted
+	if cfg.HeaderTimeoutMs > 0 {
+		policy.HeaderTimeout = time.Duration(cfg.HeaderTimeoutMs) * time.Millisecond
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return policy.Listen(ln), nil
+}
+
+// listenUnix listens on the Unix socket at path, replacing the socket file
+// of an earlier run unless something still accepts connections on it. The
+// file is removed when the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix socket %s is in use", path)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// plainHTTPHandler returns the handler of the plain HTTP listener that runs
+// next to the HTTPS one: handler itself, or a redirect to HTTPS.
+func plainHTTPHandler(handler http.Handler, cfg config.LoadBalancerConfig, hasTLS bool) (http.Handler, error) {
+	if !hasTLS {
+		return nil, fmt.Errorf("http_port needs TLS to be set up on port %d", cfg.Port)
+	}
+	if !cfg.HTTPSRedirect.Enabled {
+		return handler, nil
+	}
+
+	redirect := listener.DefaultRedirect()
+	redirect.HTTPSPort = cfg.Port
+	switch cfg.HTTPSRedirect.StatusCode {
+	case 0:
+	case http.StatusMovedPermanently, http.StatusPermanentRedirect:
+		redirect.Status = cfg.HTTPSRedirect.StatusCode
+	default:
+		return nil, fmt.Errorf("https_redirect status_code must be 301 or 308, got %d", cfg.HTTPSRedirect.StatusCode)
+	}
+	if cfg.HTTPSRedirect.ExemptPaths != nil {
+		redirect.Exempt = cfg.HTTPSRedirect.ExemptPaths
+	}
+	return listener.RedirectToHTTPS(handler, redirect), nil
+}
+
+// defaultCertReloadInterval is used when the TLS settings do not set one.
+const defaultCertReloadInterval = 10 * time.Second
+
+// newTLSConfig loads the listener's certificates and TLS settings, and
+// starts watching the certificate files for changes. It returns nil when no
+// certificate is configured, for plain HTTP.
+func newTLSConfig(logger *log.Logger, cfg config.LoadBalancerConfig) (*tls.Config, error) {
+	var pairs []listener.KeyPair
+	if cfg.TLSCertFile != "" {
+		pairs = append(pairs, listener.KeyPair{CertFile: cfg.TLSCertFile, KeyFile: cfg.TLSKeyFile})
+	}
+	for _, c := range cfg.TLS.Certificates {
+		pairs = append(pairs, listener.KeyPair{CertFile: c.CertFile, KeyFile: c.KeyFile})
+	}
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	opts := listener.DefaultOptions()
+	if cfg.TLS.MinVersion != "" {
+		version, err := listener.ParseVersion(cfg.TLS.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+		opts.MinVersion = version
+	}
+	suites, err := listener.ParseCipherSuites(cfg.TLS.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	opts.CipherSuites = suites
+	if len(cfg.TLS.ALPN) > 0 {
+		opts.NextProtos = cfg.TLS.ALPN
+	}
+	if opts.ClientAuth, err = listener.ParseClientAuth(cfg.TLS.ClientAuth); err != nil {
+		return nil, err
+	}
+	if opts.ClientAuth != tls.NoClientCert {
+		if cfg.TLS.ClientCAFile == "" {
+			return nil, fmt.Errorf("client_auth %q needs a client_ca_file", cfg.TLS.ClientAuth)
+		}
+		if opts.ClientCAs, err = loadCertPool(cfg.TLS.ClientCAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	certs, err := listener.LoadCertificates(logger, pairs)
+	if err != nil {
+		return nil, err
+	}
+	reloadInterval := time.Duration(cfg.TLS.ReloadIntervalSeconds) * time.Second
+	if reloadInterval <= 0 {
+		reloadInterval = defaultCertReloadInterval
+	}
+	certs.WatchFiles(reloadInterval)
+
+	return listener.NewTLSConfig(certs, opts), nil
+}
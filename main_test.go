@@ -1,16 +1,25 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"loadbalancer/balancer"
 	"loadbalancer/config"
+	"loadbalancer/router"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // MockServer represents a test HTTP server
@@ -44,18 +53,14 @@ func createTestConfig(t *testing.T, servers []MockServer) string {
 	}
 
 	configData := config.Config{
-		LoadBalancer: struct {
-			Port                       int    "json:\"port\""
-			HealthCheckIntervalSeconds int    "json:\"health_check_interval_seconds\""
-			Strategy                   string "json:\"strategy\""
-		}{
-			Port:                       8080,
-			HealthCheckIntervalSeconds: 5,
-			Strategy:                   "round_robin",
+		LoadBalancer: config.LoadBalancerConfig{
+			Port: 8080,
+			PoolConfig: config.PoolConfig{
+				HealthCheckIntervalSeconds: 5,
+				Strategy:                   "round_robin",
+			},
 		},
-		Servers: struct {
-			URLs []string "json:\"urls\""
-		}{
+		Servers: config.ServersConfig{
 			URLs: urls,
 		},
 	}
@@ -73,6 +78,23 @@ func createTestConfig(t *testing.T, servers []MockServer) string {
 	return file.Name()
 }
 
+// routerFromJSON loads configJSON as a config file and builds its router.
+func routerFromJSON(t *testing.T, configJSON string) *router.Router {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(configJSON), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	rt, err := newRouter(nil, cfg)
+	if err != nil {
+		t.Fatalf("Failed to build router: %v", err)
+	}
+	return rt
+}
+
 func TestLoadBalancerInitialization(t *testing.T) {
 	// Setup mock servers
 	mockServers := setupMockServers(2)
@@ -222,3 +244,406 @@ func TestLoadBalancerRequestHandling(t *testing.T) {
 		t.Error("Expected non-empty response body")
 	}
 }
+
+func TestH2CListener(t *testing.T) {
+	mockServers := setupMockServers(1)
+	defer mockServers[0].server.Close()
+
+	lb := balancer.NewLoadBalancer(nil, "round_robin")
+	if err := lb.AddServer(mockServers[0].URL); err != nil {
+		t.Fatalf("Failed to add server: %v", err)
+	}
+
+	srv, err := newHTTPServer("", lb, config.LoadBalancerConfig{H2C: true}, nil)
+	if err != nil {
+		t.Fatalf("Failed to set up server: %v", err)
+	}
+	front := httptest.NewUnstartedServer(srv.Handler)
+	front.Config = srv
+	front.Start()
+	defer front.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+	resp, err := client.Get(front.URL)
+	if err != nil {
+		t.Fatalf("Failed to send h2c request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2 response, got %s", resp.Proto)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status OK, got %v", resp.Status)
+	}
+}
+
+func TestGRPCRetryableStatus(t *testing.T) {
+	newBackend := func(status string) *httptest.Server {
+		return httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", status)
+		}), &http2.Server{}))
+	}
+	unavailable := newBackend("14")
+	defer unavailable.Close()
+	ok := newBackend("0")
+	defer ok.Close()
+
+	for _, tc := range []struct {
+		retryable []int
+		expected  string
+	}{
+		{retryable: []int{14}, expected: "0"},
+		{retryable: nil, expected: "14"},
+	} {
+		lb := balancer.NewLoadBalancer(nil, "round_robin")
+		lb.RetryPolicy.GRPCRetryableCodes = tc.retryable
+		for _, backend := range []*httptest.Server{unavailable, ok} {
+			if err := lb.AddServer("h2c://" + backend.Listener.Addr().String()); err != nil {
+				t.Fatalf("Failed to add server: %v", err)
+			}
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/pkg.Service/Method", nil)
+		req.Header.Set("Content-Type", "application/grpc")
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, req)
+
+		if got := w.Result().Header.Get("Grpc-Status"); got != tc.expected {
+			t.Errorf("Expected grpc-status %s with retryable codes %v, got %s", tc.expected, tc.retryable, got)
+		}
+	}
+}
+
+func TestPoolsFromConfig(t *testing.T) {
+	mockServers := setupMockServers(2)
+	defer func() {
+		for _, s := range mockServers {
+			s.server.Close()
+		}
+	}()
+
+	cfg := &config.Config{
+		Pools: map[string]config.PoolConfig{
+			"api": {Hosts: []string{"api.example.com"}, URLs: []string{mockServers[0].URL}, Strategy: "round_robin"},
+			"web": {Hosts: []string{"*.example.com"}, URLs: []string{mockServers[1].URL}, HealthCheckPath: "/health"},
+		},
+		DefaultPool: "web",
+	}
+	rt, err := newRouter(nil, cfg)
+	if err != nil {
+		t.Fatalf("Failed to build pools: %v", err)
+	}
+
+	for host, expected := range map[string]string{
+		"api.example.com": "Mock Server 1",
+		"www.example.com": "Mock Server 2",
+		"other.org":       "Mock Server 2",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, req)
+		if w.Body.String() != expected {
+			t.Errorf("Expected host %s to be served by %s, got %q", host, expected, w.Body.String())
+		}
+	}
+
+	if _, err := newRouter(nil, &config.Config{Pools: cfg.Pools, DefaultPool: "missing"}); err == nil {
+		t.Error("Expected an unknown default pool to be rejected")
+	}
+	invalid := map[string]config.PoolConfig{"api": {URLs: []string{"http://localhost:port"}}}
+	if _, err := newRouter(nil, &config.Config{Pools: invalid}); err == nil {
+		t.Error("Expected an invalid server URL to be rejected")
+	}
+}
+
+func TestRoutesFromConfig(t *testing.T) {
+	mockServers := setupMockServers(2)
+	defer func() {
+		for _, s := range mockServers {
+			s.server.Close()
+		}
+	}()
+
+	configJSON := fmt.Sprintf(`{
+		"servers": {"urls": [%q]},
+		"pools": {"acme": {"urls": [%q]}},
+		"routes": [{
+			"name": "acme",
+			"pool": "acme",
+			"path_prefix": "/api/",
+			"strip_prefix": true,
+			"any": [
+				{"headers": [{"name": "X-Tenant", "value": "acme"}]},
+				{"query": [{"name": "tenant", "regex": "^acme$"}]}
+			]
+		}]
+	}`, mockServers[0].URL, mockServers[1].URL)
+
+	rt := routerFromJSON(t, configJSON)
+
+	for target, expected := range map[string]string{
+		"/api/users?tenant=acme": "Mock Server 2",
+		"/api/users":             "Mock Server 1",
+	} {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Body.String() != expected {
+			t.Errorf("Expected %s to be served by %s, got %q", target, expected, w.Body.String())
+		}
+	}
+}
+
+func TestSplitAdminAPI(t *testing.T) {
+	mockServers := setupMockServers(2)
+	defer func() {
+		for _, s := range mockServers {
+			s.server.Close()
+		}
+	}()
+
+	configJSON := fmt.Sprintf(`{
+		"pools": {"stable": {"urls": [%q]}, "canary": {"urls": [%q]}},
+		"routes": [{
+			"name": "web",
+			"path_prefix": "/",
+			"sticky_cookie": "session",
+			"splits": [{"pool": "stable", "weight": 100}, {"pool": "canary", "weight": 0}]
+		}]
+	}`, mockServers[0].URL, mockServers[1].URL)
+
+	rt := routerFromJSON(t, configJSON)
+	admin := httptest.NewServer(newAdminHandler(rt, ""))
+	defer admin.Close()
+
+	served := func() string {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Body.String()
+	}
+	if got := served(); got != "Mock Server 1" {
+		t.Fatalf("Expected the stable pool, got %q", got)
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, admin.URL+"/splits/web", strings.NewReader(`{"stable": 0, "canary": 100}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to set weights: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 setting weights, got %d", resp.StatusCode)
+	}
+	if got := served(); got != "Mock Server 2" {
+		t.Fatalf("Expected the canary pool after the weights changed, got %q", got)
+	}
+
+	resp, err = http.Get(admin.URL + "/splits")
+	if err != nil {
+		t.Fatalf("Failed to get splits: %v", err)
+	}
+	defer resp.Body.Close()
+	var splits map[string][]router.SplitMetrics
+	if err := json.NewDecoder(resp.Body).Decode(&splits); err != nil {
+		t.Fatalf("Failed to decode splits: %v", err)
+	}
+	if arms := splits["web"]; len(arms) != 2 || arms[0].Requests != 1 || arms[1].Requests != 1 || arms[1].Weight != 100 {
+		t.Errorf("Unexpected split metrics %+v", splits)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, admin.URL+"/splits/web", strings.NewReader(`{"missing": 5}`))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to set weights: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown pool, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminAPIToken(t *testing.T) {
+	admin := httptest.NewServer(newAdminHandler(router.NewRouter(nil), "secret"))
+	defer admin.Close()
+
+	for auth, expected := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, admin.URL+"/metrics", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to get metrics: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("Expected status %d with Authorization %q, got %d", expected, auth, resp.StatusCode)
+		}
+	}
+}
+
+func TestRolloutAdminAPI(t *testing.T) {
+	mockServers := setupMockServers(2)
+	defer func() {
+		for _, s := range mockServers {
+			s.server.Close()
+		}
+	}()
+
+	configJSON := fmt.Sprintf(`{
+		"pools": {"stable": {"urls": [%q]}, "canary": {"urls": [%q]}},
+		"routes": [{
+			"name": "web",
+			"path_prefix": "/",
+			"splits": [{"pool": "stable", "weight": 100}, {"pool": "canary", "weight": 0}],
+			"rollout": {"baseline": "stable", "canary": "canary", "steps": [5, 100], "step_interval_seconds": 3600}
+		}]
+	}`, mockServers[0].URL, mockServers[1].URL)
+
+	rt := routerFromJSON(t, configJSON)
+	defer rt.GracefulShutdown()
+	admin := httptest.NewServer(newAdminHandler(rt, ""))
+	defer admin.Close()
+
+	getRollout := func() router.RolloutStatus {
+		resp, err := http.Get(admin.URL + "/rollouts")
+		if err != nil {
+			t.Fatalf("Failed to get rollouts: %v", err)
+		}
+		defer resp.Body.Close()
+		var rollouts map[string]router.RolloutStatus
+		if err := json.NewDecoder(resp.Body).Decode(&rollouts); err != nil {
+			t.Fatalf("Failed to decode rollouts: %v", err)
+		}
+		return rollouts["web"]
+	}
+
+	// The rollout started with the configuration takes its first step
+	deadline := time.Now().Add(2 * time.Second)
+	for getRollout().CanaryPercent != 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if status := getRollout(); status.State != router.RolloutRunning || status.CanaryPercent != 5 {
+		t.Fatalf("Expected the rollout to run at 5%%, got %+v", status)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, admin.URL+"/rollouts/web", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to abort rollout: %v", err)
+	}
+	resp.Body.Close()
+	if status := getRollout(); status.State != router.RolloutAborted || status.CanaryPercent != 0 {
+		t.Errorf("Expected the rollout to be aborted, got %+v", status)
+	}
+	if splits, _ := rt.Splits("web"); splits[0].Weight != 100 || splits[1].Weight != 0 {
+		t.Errorf("Expected abort to restore the baseline, got %+v", splits)
+	}
+
+	resp, err = http.Post(admin.URL+"/rollouts/web", "application/json", strings.NewReader(`{"baseline": "stable", "canary": "missing"}`))
+	if err != nil {
+		t.Fatalf("Failed to start rollout: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown canary, got %d", resp.StatusCode)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "lb.sock")
+	ln, err := listenUnix(socket)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatalf("request over the socket failed: %v", err)
+	}
+	resp.Body.Close()
+
+	// A socket still in use is left alone
+	if _, err := listenUnix(socket); err == nil {
+		t.Error("expected a socket in use to be refused")
+	}
+
+	// A socket file left behind is replaced
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = listenUnix(socket)
+	if err != nil {
+		t.Fatalf("expected a stale socket to be replaced: %v", err)
+	}
+	ln.Close()
+}
+
+func TestAffinityAcrossPools(t *testing.T) {
+	mockServers := setupMockServers(4)
+	defer func() {
+		for _, s := range mockServers {
+			s.server.Close()
+		}
+	}()
+
+	affinity := config.AffinityConfig{Mode: "cookie"}
+	cfg := &config.Config{
+		Pools: map[string]config.PoolConfig{
+			"api": {Hosts: []string{"api.example.com"}, URLs: []string{mockServers[0].URL, mockServers[1].URL}, Strategy: "round_robin", Affinity: affinity},
+			"web": {Hosts: []string{"www.example.com"}, URLs: []string{mockServers[2].URL, mockServers[3].URL}, Strategy: "round_robin", Affinity: affinity},
+		},
+		DefaultPool: "web",
+	}
+	rt, err := newRouter(nil, cfg)
+	if err != nil {
+		t.Fatalf("Failed to build pools: %v", err)
+	}
+
+	// Each pool pins the client with its own cookie, which the other pool
+	// leaves alone
+	cookies := map[string]*http.Cookie{}
+	served := map[string]string{}
+	for range 3 {
+		for _, host := range []string{"api.example.com", "www.example.com"} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = host
+			for _, c := range cookies {
+				req.AddCookie(c)
+			}
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, req)
+			for _, c := range w.Result().Cookies() {
+				cookies[c.Name] = c
+			}
+			if first, ok := served[host]; ok && w.Body.String() != first {
+				t.Errorf("Expected %s to stay on %s, got %s", host, first, w.Body.String())
+			}
+			served[host] = w.Body.String()
+		}
+	}
+	if len(cookies) != 2 || cookies["lb_affinity_api"] == nil || cookies["lb_affinity_web"] == nil {
+		t.Errorf("Expected a cookie per pool, got %v", cookies)
+	}
+}
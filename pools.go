@@ -0,0 +1,428 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"loadbalancer/balancer"
+	"loadbalancer/config"
+	"loadbalancer/router"
+	sv "loadbalancer/server"
+)
+
+// defaultPoolName names the pool built from servers.urls.
+const defaultPoolName = "default"
+
+// defaultHealthCheckInterval is used when a pool does not set one.
+const defaultHealthCheckInterval = 30 * time.Second
+
+// defaultTCPIdleTimeout is used when a TCP listener does not set one.
+const defaultTCPIdleTimeout = time.Hour
+
+// newRouter builds every configured pool and routes hosts and routes to them. The
+// top-level load_balancer settings and servers.urls make up the "default"
+// pool, so single-pool configurations keep working unchanged.
+func newRouter(logger *log.Logger, cfg *config.Config) (*router.Router, error) {
+	rt := router.NewRouter(logger)
+
+	if len(cfg.Servers.URLs) > 0 || len(cfg.Pools) == 0 {
+		poolCfg := cfg.LoadBalancer.PoolConfig
+		poolCfg.URLs = append(poolCfg.URLs, cfg.Servers.URLs...)
+		lb, err := newPool(logger, defaultPoolName, poolCfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := rt.AddPool(lb, poolCfg.Hosts...); err != nil {
+			return nil, err
+		}
+	}
+	for name, poolCfg := range cfg.Pools {
+		lb, err := newPool(logger, name, poolCfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := rt.AddPool(lb, poolCfg.Hosts...); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, routeCfg := range cfg.Routes {
+		route := router.Route{
+			Name:          routeCfg.Name,
+			Match:         match(routeCfg.MatchConfig),
+			Pool:          routeCfg.Pool,
+			StickyCookie:  routeCfg.StickyCookie,
+			StickyHeader:  routeCfg.StickyHeader,
+			StripPrefix:   routeCfg.StripPrefix,
+			PrefixRewrite: routeCfg.PrefixRewrite,
+			RegexRewrite:  routeCfg.RegexRewrite,
+			Timeouts:      timeouts(sv.Timeouts{}, routeCfg.Timeouts),
+			Deny:          routeCfg.Deny,
+		}
+		if m := routeCfg.Mirror; m != nil {
+			route.Mirror = router.Mirror{Pool: m.Pool, Percent: m.Percent, MaxBodyBytes: m.MaxBodyBytes}
+		}
+		for _, s := range routeCfg.Splits {
+			route.Splits = append(route.Splits, router.Split{Pool: s.Pool, Weight: s.Weight})
+		}
+		if err := rt.AddRoute(route); err != nil {
+			return nil, err
+		}
+		if routeCfg.Rollout != nil {
+			if err := rt.StartRollout(rollout(routeCfg.Name, *routeCfg.Rollout)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	defaultPool := cfg.DefaultPool
+	if defaultPool == "" {
+		defaultPool = defaultPoolName
+	}
+	if rt.Pool(defaultPool) != nil {
+		if err := rt.SetDefault(defaultPool); err != nil {
+			return nil, err
+		}
+	} else if cfg.DefaultPool != "" {
+		return nil, fmt.Errorf("default pool %s not found", cfg.DefaultPool)
+	}
+
+	return rt, nil
+}
+
+// match converts configured match conditions for the router.
+func match(cfg config.MatchConfig) router.Match {
+	values := func(cfgs []config.ValueMatchConfig) []router.ValueMatch {
+		var vms []router.ValueMatch
+		for _, c := range cfgs {
+			vms = append(vms, router.ValueMatch{Name: c.Name, Value: c.Value, Regex: c.Regex})
+		}
+		return vms
+	}
+
+	m := router.Match{
+		Hosts:      cfg.Hosts,
+		Methods:    cfg.Methods,
+		Path:       cfg.Path,
+		PathPrefix: cfg.PathPrefix,
+		PathRegex:  cfg.PathRegex,
+		Headers:    values(cfg.Headers),
+		Query:      values(cfg.Query),
+		Cookies:    values(cfg.Cookies),
+		ClientCert: values(cfg.ClientCert),
+	}
+	for _, alt := range cfg.Any {
+		m.Any = append(m.Any, match(alt))
+	}
+	return m
+}
+
+// rollout converts a configured rollout of the named route for the router.
+func rollout(route string, cfg config.RolloutConfig) router.Rollout {
+	ro := router.DefaultRollout()
+	ro.Route = route
+	ro.Baseline = cfg.Baseline
+	ro.Canary = cfg.Canary
+	if len(cfg.Steps) > 0 {
+		ro.Steps = cfg.Steps
+	}
+	if cfg.StepIntervalSeconds > 0 {
+		ro.StepInterval = time.Duration(cfg.StepIntervalSeconds) * time.Second
+	}
+	if cfg.MinRequests != nil {
+		ro.MinRequests = uint64(max(*cfg.MinRequests, 0))
+	}
+	if cfg.MaxErrorRateIncrease != nil {
+		ro.MaxErrorRateIncrease = *cfg.MaxErrorRateIncrease
+	}
+	if cfg.MaxP99Ratio != nil {
+		ro.MaxP99Ratio = *cfg.MaxP99Ratio
+	}
+	return ro
+}
+
+// newPool creates a load balancer for one pool and starts its health checks.
+func newPool(logger *log.Logger, name string, cfg config.PoolConfig) (*balancer.LoadBalancer, error) {
+	lb := balancer.NewLoadBalancer(logger, cfg.Strategy)
+	lb.Name = name
+	lb.ServerOptions.FlushInterval = time.Duration(cfg.FlushIntervalMs) * time.Millisecond
+	lb.ServerOptions.StreamContentTypes = cfg.StreamContentTypes
+	lb.ServerOptions.OutlierFailures = cfg.OutlierFailures
+	lb.ServerOptions.Timeouts = timeouts(lb.ServerOptions.Timeouts, cfg.Timeouts)
+	lb.ServerOptions.DeadlineHeader = cfg.DeadlineHeader
+	lb.ServerOptions.HealthCheckPath = cfg.HealthCheckPath
+	if cfg.PreserveHost && cfg.HostRewrite != "" {
+		return nil, fmt.Errorf("pool %s: preserve_host and host_rewrite cannot both be set", name)
+	}
+	lb.ServerOptions.PreserveHost = cfg.PreserveHost
+	lb.ServerOptions.HostRewrite = cfg.HostRewrite
+	lb.ServerOptions.RewriteRedirects = cfg.RewriteRedirects
+	lb.ServerOptions.CookieDomains = cfg.CookieDomains
+	lb.ServerOptions.CookiePaths = cfg.CookiePaths
+	tlsConfig, err := upstreamTLS(cfg.UpstreamTLS)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %v", name, err)
+	}
+	lb.ServerOptions.TLS = tlsConfig
+	lb.RetryPolicy.GRPCRetryableCodes = cfg.GRPCRetryableCodes
+	if len(cfg.RetryMethods) > 0 {
+		lb.RetryPolicy.Methods = cfg.RetryMethods
+	}
+	if len(cfg.RetryOn) > 0 {
+		lb.RetryPolicy.RetryOn = cfg.RetryOn
+	}
+	if cfg.MaxRetries != nil {
+		lb.RetryPolicy.MaxRetries = *cfg.MaxRetries
+	}
+	if cfg.RetryBudgetPercent != nil {
+		lb.RetryPolicy.BudgetPercent = *cfg.RetryBudgetPercent
+	}
+	if cfg.RetryBudgetMinPerSecond != nil {
+		lb.RetryPolicy.MinRetriesPerSecond = *cfg.RetryBudgetMinPerSecond
+	}
+	if cfg.RetryBackoffBaseMs != nil {
+		lb.RetryPolicy.BackoffBase = time.Duration(*cfg.RetryBackoffBaseMs) * time.Millisecond
+	}
+	if cfg.RetryBackoffMaxMs != nil {
+		lb.RetryPolicy.BackoffMax = time.Duration(*cfg.RetryBackoffMaxMs) * time.Millisecond
+	}
+	if cfg.RetryBufferBytes != nil {
+		lb.RetryPolicy.BufferBytes = *cfg.RetryBufferBytes
+	}
+	lb.HedgePolicy.Enabled = cfg.HedgeEnabled
+	lb.HedgePolicy.Delay = time.Duration(cfg.HedgeDelayMs) * time.Millisecond
+	if cfg.HedgeBudgetPercent != nil {
+		lb.HedgePolicy.BudgetPercent = *cfg.HedgeBudgetPercent
+	}
+
+	// Pools have their own secrets and servers, so clients reaching several
+	// of them need a cookie for each
+	lb.AffinityPolicy.Cookie.Name = affinityCookieName(name)
+	affinity, err := affinity(lb.AffinityPolicy, cfg.Affinity)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %v", name, err)
+	}
+	lb.AffinityPolicy = affinity
+
+	// Add servers from configuration
+	for _, url := range cfg.URLs {
+		if err := lb.AddServer(url); err != nil {
+			return nil, fmt.Errorf("pool %s: %v", name, err)
+		}
+	}
+
+	// Start health checks
+	healthCheckInterval := time.Duration(cfg.HealthCheckIntervalSeconds) * time.Second
+	if healthCheckInterval <= 0 {
+		healthCheckInterval = defaultHealthCheckInterval
+	}
+	lb.StartHealthChecks(healthCheckInterval)
+
+	return lb, nil
+}
+
+// newTCPPool creates a load balancer for the servers of a TCP listener and
+// starts its health checks, which only check that servers accept
+// connections.
+func newTCPPool(logger *log.Logger, name string, cfg config.TCPListenerConfig) (*balancer.LoadBalancer, error) {
+	lb := balancer.NewLoadBalancer(logger, cfg.Strategy)
+	lb.Name = name
+	if cfg.ConnectTimeoutMs > 0 {
+		lb.ServerOptions.Timeouts.Connect = time.Duration(cfg.ConnectTimeoutMs) * time.Millisecond
+	}
+	lb.ServerOptions.IdleTimeout = defaultTCPIdleTimeout
+	if cfg.IdleTimeoutSeconds > 0 {
+		lb.ServerOptions.IdleTimeout = time.Duration(cfg.IdleTimeoutSeconds) * time.Second
+	}
+	if cfg.DrainTimeoutSeconds > 0 {
+		lb.DrainTimeout = time.Duration(cfg.DrainTimeoutSeconds) * time.Second
+	}
+	switch cfg.SendProxyProtocol {
+	case 0, 1, 2:
+		lb.ServerOptions.ProxyProtocol = cfg.SendProxyProtocol
+	default:
+		return nil, fmt.Errorf("tcp listener %s: send_proxy_protocol must be 1 or 2, got %d", name, cfg.SendProxyProtocol)
+	}
+
+	for _, url := range cfg.URLs {
+		if !strings.Contains(url, "://") {
+			url = "tcp://" + url
+		}
+		if !strings.HasPrefix(url, "tcp://") {
+			return nil, fmt.Errorf("tcp listener %s: %s is not a TCP server", name, url)
+		}
+		if err := lb.AddServer(url); err != nil {
+			return nil, fmt.Errorf("tcp listener %s: %v", name, err)
+		}
+	}
+
+	healthCheckInterval := time.Duration(cfg.HealthCheckIntervalSeconds) * time.Second
+	if healthCheckInterval <= 0 {
+		healthCheckInterval = defaultHealthCheckInterval
+	}
+	lb.StartHealthChecks(healthCheckInterval)
+
+	return lb, nil
+}
+
+// newUDPPool creates a load balancer for the servers of a UDP listener. UDP
+// servers are not health checked, as there is no generic way to probe them.
+func newUDPPool(logger *log.Logger, name string, cfg config.UDPListenerConfig) (*balancer.LoadBalancer, error) {
+	lb := balancer.NewLoadBalancer(logger, cfg.Strategy)
+	lb.Name = name
+	switch cfg.Mode {
+	case "", "session":
+	case "packet":
+		lb.UDPPolicy.PerPacket = true
+	default:
+		return nil, fmt.Errorf("udp listener %s: unknown mode %q", name, cfg.Mode)
+	}
+	if cfg.SessionIdleSeconds > 0 {
+		lb.UDPPolicy.SessionIdle = time.Duration(cfg.SessionIdleSeconds) * time.Second
+	}
+	if cfg.MaxSessions > 0 {
+		lb.UDPPolicy.MaxSessions = cfg.MaxSessions
+	}
+
+	for _, url := range cfg.URLs {
+		if !strings.Contains(url, "://") {
+			url = "udp://" + url
+		}
+		if !strings.HasPrefix(url, "udp://") {
+			return nil, fmt.Errorf("udp listener %s: %s is not a UDP server", name, url)
+		}
+		if err := lb.AddServer(url); err != nil {
+			return nil, fmt.Errorf("udp listener %s: %v", name, err)
+		}
+	}
+
+	return lb, nil
+}
+
+// affinityCookieName returns the default affinity cookie name of a pool,
+// "lb_affinity_<pool>", keeping only the characters a cookie name allows.
+func affinityCookieName(pool string) string {
+	name := []byte("lb_affinity_")
+	for _, c := range []byte(pool) {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' {
+			name = append(name, c)
+		} else {
+			name = append(name, '_')
+		}
+	}
+	return string(name)
+}
+
+// affinity applies the configured affinity settings on top of defaults.
+func affinity(defaults balancer.AffinityPolicy, cfg config.AffinityConfig) (balancer.AffinityPolicy, error) {
+	policy := defaults
+	switch cfg.Mode {
+	case balancer.AffinityNone, balancer.AffinityCookie:
+		policy.Mode = cfg.Mode
+	case balancer.AffinityLearn:
+		if cfg.CookieName == "" {
+			return policy, fmt.Errorf("affinity mode %q needs the application's cookie_name", cfg.Mode)
+		}
+		policy.Mode = cfg.Mode
+	default:
+		return policy, fmt.Errorf("unknown affinity mode %q", cfg.Mode)
+	}
+
+	c := &policy.Cookie
+	if cfg.CookieName != "" {
+		c.Name = cfg.CookieName
+	}
+	if cfg.CookiePath != "" {
+		c.Path = cfg.CookiePath
+	}
+	c.Domain = cfg.CookieDomain
+	c.MaxAge = cfg.CookieTTLSeconds
+	c.Secure = cfg.CookieSecure
+	if cfg.CookieHTTPOnly != nil {
+		c.HttpOnly = *cfg.CookieHTTPOnly
+	}
+	switch strings.ToLower(cfg.CookieSameSite) {
+	case "":
+	case "lax":
+		c.SameSite = http.SameSiteLaxMode
+	case "strict":
+		c.SameSite = http.SameSiteStrictMode
+	case "none":
+		c.SameSite = http.SameSiteNoneMode
+	default:
+		return policy, fmt.Errorf("unknown cookie_same_site %q", cfg.CookieSameSite)
+	}
+	if cfg.CookieSecret != "" {
+		policy.Secret = []byte(cfg.CookieSecret)
+	}
+	if cfg.TableSize > 0 {
+		policy.TableSize = cfg.TableSize
+	}
+	if cfg.TableTTLSeconds > 0 {
+		policy.TableTTL = time.Duration(cfg.TableTTLSeconds) * time.Second
+	}
+	return policy, nil
+}
+
+// upstreamTLS builds the TLS settings for a pool's servers, or nil to use
+// Go's defaults.
+func upstreamTLS(cfg config.UpstreamTLSConfig) (*tls.Config, error) {
+	if cfg == (config.UpstreamTLSConfig{}) {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// loadCertPool loads a PEM bundle of CA certificates.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// timeouts applies the configured timeouts on top of defaults.
+func timeouts(defaults sv.Timeouts, cfg config.TimeoutsConfig) sv.Timeouts {
+	ms := func(v int, fallback time.Duration) time.Duration {
+		if v > 0 {
+			return time.Duration(v) * time.Millisecond
+		}
+		return fallback
+	}
+	return sv.Timeouts{
+		Connect:        ms(cfg.ConnectMs, defaults.Connect),
+		TLSHandshake:   ms(cfg.TLSHandshakeMs, defaults.TLSHandshake),
+		ResponseHeader: ms(cfg.ResponseHeaderMs, defaults.ResponseHeader),
+		IdleBody:       ms(cfg.IdleBodyMs, defaults.IdleBody),
+		Total:          ms(cfg.TotalMs, defaults.Total),
+	}
+}
@@ -0,0 +1,333 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"loadbalancer/utils"
+)
+
+// Rollout states.
+const (
+	RolloutRunning    = "running"
+	RolloutPromoted   = "promoted"
+	RolloutRolledBack = "rolled_back"
+	RolloutAborted    = "aborted"
+)
+
+// rolloutCheckInterval is how often a running step is judged, unless the
+// step is shorter.
+const rolloutCheckInterval = time.Second
+
+// Rollout moves a split route's traffic from a baseline pool to a canary
+// pool step by step. Each step lasts at least StepInterval and until the
+// canary has served MinRequests during it. Throughout, the canary's error
+// rate and p99 latency in the step are compared with the baseline's, and the
+// rollout is rolled back, sending all traffic to the baseline, as soon as
+// either is worse than the thresholds allow. Any other pools the route
+// splits to get no traffic while the rollout runs, and the split's weights
+// cannot be set by hand.
+type Rollout struct {
+	Route    string
+	Baseline string
+	Canary   string
+
+	// Steps are the canary's successive percentages of traffic, ending
+	// with 100, such as 1, 5, 25, 100.
+	Steps        []int
+	StepInterval time.Duration
+	MinRequests  uint64
+
+	// MaxErrorRateIncrease is how much higher than the baseline's the
+	// canary's error rate may be, as a fraction: 0.01 allows one more
+	// failed request in a hundred.
+	MaxErrorRateIncrease float64
+
+	// MaxP99Ratio is how many times the baseline's p99 latency the
+	// canary's may be. Zero disables the latency check.
+	MaxP99Ratio float64
+
+	// OnEvent, when set, is called with every event of the rollout.
+	OnEvent func(RolloutEvent)
+}
+
+// DefaultRollout returns the rollout settings used when none are configured.
+func DefaultRollout() Rollout {
+	return Rollout{
+		Steps:                []int{1, 5, 25, 100},
+		StepInterval:         5 * time.Minute,
+		MinRequests:          100,
+		MaxErrorRateIncrease: 0.01,
+		MaxP99Ratio:          1.5,
+	}
+}
+
+// RolloutEvent records a change in a rollout: a new step, or the rollout
+// ending by promotion, rollback or abort.
+type RolloutEvent struct {
+	Time          time.Time
+	Route         string
+	State         string
+	CanaryPercent int
+	Reason        string `json:",omitempty"`
+}
+
+// RolloutStatus describes a rollout and everything that happened in it.
+type RolloutStatus struct {
+	Route         string
+	Baseline      string
+	Canary        string
+	State         string
+	CanaryPercent int
+	Events        []RolloutEvent
+}
+
+type rollout struct {
+	Rollout
+	split    *split
+	baseline *splitArm
+	canary   *splitArm
+	cancel   context.CancelFunc
+
+	mu     sync.Mutex
+	status RolloutStatus
+}
+
+// StartRollout starts moving the route's traffic to the canary in the
+// background. A route runs at most one rollout at a time.
+func (rt *Router) StartRollout(ro Rollout) error {
+	if len(ro.Steps) == 0 || ro.Steps[len(ro.Steps)-1] != 100 {
+		return fmt.Errorf("rollout of %s: steps must end with 100", ro.Route)
+	}
+	for i, step := range ro.Steps {
+		if step <= 0 || (i > 0 && step <= ro.Steps[i-1]) {
+			return fmt.Errorf("rollout of %s: steps must be increasing percentages", ro.Route)
+		}
+	}
+	if ro.StepInterval <= 0 {
+		return fmt.Errorf("rollout of %s: step interval must be positive", ro.Route)
+	}
+
+	cr := rt.namedRoute(ro.Route)
+	if cr == nil {
+		return fmt.Errorf("route %s not found", ro.Route)
+	}
+	if cr.Deny {
+		return fmt.Errorf("rollout of %s: the route denies requests", ro.Route)
+	}
+	arm := func(pool string) *splitArm {
+		i := slices.IndexFunc(cr.split.arms, func(a *splitArm) bool { return a.pool.Name == pool })
+		if i < 0 {
+			return nil
+		}
+		return cr.split.arms[i]
+	}
+	r := &rollout{Rollout: ro, split: cr.split, baseline: arm(ro.Baseline), canary: arm(ro.Canary)}
+	if r.baseline == nil || r.canary == nil || r.baseline == r.canary {
+		return fmt.Errorf("rollout of %s: baseline and canary must be two pools the route splits to", ro.Route)
+	}
+	r.status = RolloutStatus{Route: ro.Route, Baseline: ro.Baseline, Canary: ro.Canary, State: RolloutRunning}
+
+	// r.mu is never held while taking rt.mu, so the state can be checked here
+	rt.mu.Lock()
+	if running, ok := rt.rollouts[ro.Route]; ok && running.state() == RolloutRunning {
+		rt.mu.Unlock()
+		return fmt.Errorf("route %s already has a rollout running", ro.Route)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	rt.rollouts[ro.Route] = r
+	rt.mu.Unlock()
+
+	go r.run(ctx, rt)
+	return nil
+}
+
+// AbortRollout stops the route's running rollout and sends all of its
+// traffic back to the baseline.
+func (rt *Router) AbortRollout(route string) error {
+	rt.mu.RLock()
+	r, ok := rt.rollouts[route]
+	rt.mu.RUnlock()
+	if !ok || r.state() != RolloutRunning {
+		return fmt.Errorf("route %s has no rollout running", route)
+	}
+	r.cancel()
+	r.end(rt, RolloutAborted, "aborted by operator")
+	return nil
+}
+
+// Rollouts returns the status of every route's latest rollout.
+func (rt *Router) Rollouts() map[string]RolloutStatus {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	statuses := make(map[string]RolloutStatus, len(rt.rollouts))
+	for route, r := range rt.rollouts {
+		r.mu.Lock()
+		status := r.status
+		status.Events = slices.Clone(r.status.Events)
+		r.mu.Unlock()
+		statuses[route] = status
+	}
+	return statuses
+}
+
+// stopRollouts stops every running rollout where it stands.
+func (rt *Router) stopRollouts() {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	for _, r := range rt.rollouts {
+		r.cancel()
+	}
+}
+
+func (r *rollout) run(ctx context.Context, rt *Router) {
+	check := min(rolloutCheckInterval, r.StepInterval)
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+
+	for _, percent := range r.Steps {
+		if !r.setPercent(rt, percent) {
+			return
+		}
+		if percent == 100 {
+			r.end(rt, RolloutPromoted, "")
+			return
+		}
+
+		baseline, canary := r.baseline.count(), r.canary.count()
+		stepEnd := time.Now().Add(r.StepInterval)
+		for judged := false; !judged; {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				b := r.baseline.since(baseline, 100-percent)
+				c := r.canary.since(canary, percent)
+				if c.Requests < r.MinRequests {
+					continue
+				}
+				if reason := r.breach(b, c); reason != "" {
+					r.end(rt, RolloutRolledBack, reason)
+					return
+				}
+				judged = !now.Before(stepEnd)
+			}
+		}
+	}
+}
+
+// breach returns why the canary's metrics are worse than the thresholds
+// allow, or "" if they are not.
+func (r *rollout) breach(baseline, canary SplitMetrics) string {
+	if canary.ErrorRate > baseline.ErrorRate+r.MaxErrorRateIncrease {
+		return fmt.Sprintf("canary error rate %.2f%% exceeds baseline %.2f%%", canary.ErrorRate*100, baseline.ErrorRate*100)
+	}
+	if r.MaxP99Ratio > 0 && baseline.Requests > 0 && canary.LatencyP99Ms > baseline.LatencyP99Ms*r.MaxP99Ratio {
+		return fmt.Sprintf("canary p99 latency %.1fms exceeds baseline %.1fms", canary.LatencyP99Ms, baseline.LatencyP99Ms)
+	}
+	return ""
+}
+
+// setPercent sends percent of the route's traffic to the canary and the
+// rest to the baseline, unless the rollout has already ended.
+func (r *rollout) setPercent(rt *Router, percent int) bool {
+	r.mu.Lock()
+	if r.status.State != RolloutRunning {
+		r.mu.Unlock()
+		return false
+	}
+	reason := ""
+	if err := r.split.set(r.weights(percent)); err != nil {
+		r.status.State = RolloutAborted
+		reason = err.Error()
+	} else {
+		r.status.CanaryPercent = percent
+	}
+	event := r.record(reason)
+	r.mu.Unlock()
+
+	r.emit(rt, event)
+	return event.State == RolloutRunning
+}
+
+// weights gives the canary percent of the split and the baseline the rest,
+// leaving none to any other arm.
+func (r *rollout) weights(percent int) map[string]int {
+	weights := make(map[string]int, len(r.split.arms))
+	for _, arm := range r.split.arms {
+		weights[arm.pool.Name] = 0
+	}
+	weights[r.Baseline] = 100 - percent
+	weights[r.Canary] = percent
+	return weights
+}
+
+// end finishes the rollout once, sending all traffic back to the baseline
+// unless the canary was promoted.
+func (r *rollout) end(rt *Router, state, reason string) {
+	r.mu.Lock()
+	if r.status.State != RolloutRunning {
+		r.mu.Unlock()
+		return
+	}
+	if state != RolloutPromoted {
+		if err := r.split.set(r.weights(0)); err != nil {
+			reason = fmt.Sprintf("%s; restoring the baseline failed: %v", reason, err)
+		}
+		r.status.CanaryPercent = 0
+	}
+	r.status.State = state
+	event := r.record(reason)
+	r.mu.Unlock()
+
+	r.emit(rt, event)
+}
+
+// record adds an event for the rollout's current state. r.mu must be held.
+func (r *rollout) record(reason string) RolloutEvent {
+	event := RolloutEvent{
+		Time:          time.Now(),
+		Route:         r.Route,
+		State:         r.status.State,
+		CanaryPercent: r.status.CanaryPercent,
+		Reason:        reason,
+	}
+	r.status.Events = append(r.status.Events, event)
+	return event
+}
+
+// emit logs event and passes it to OnEvent.
+func (r *rollout) emit(rt *Router, event RolloutEvent) {
+	msg := fmt.Sprintf("Rollout of %s: %s, %d%% to canary %s", r.Route, event.State, event.CanaryPercent, r.Canary)
+	if event.Reason != "" {
+		msg += ": " + event.Reason
+	}
+	color := utils.GREEN
+	if event.State == RolloutRolledBack || event.State == RolloutAborted {
+		color = utils.RED
+	}
+	rt.Logger.Println(utils.Colorize(msg, color))
+
+	if r.OnEvent != nil {
+		r.OnEvent(event)
+	}
+}
+
+// rolloutRunning reports whether the route has a rollout running.
+func (rt *Router) rolloutRunning(route string) bool {
+	rt.mu.RLock()
+	r, ok := rt.rollouts[route]
+	rt.mu.RUnlock()
+	return ok && r.state() == RolloutRunning
+}
+
+func (r *rollout) state() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status.State
+}
@@ -0,0 +1,214 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loadbalancer/balancer"
+)
+
+// defaultMirrorBodyBytes is the largest request body mirrored by default.
+const defaultMirrorBodyBytes = 1 << 20
+
+// mirrorMaxInFlight bounds the mirrored requests outstanding per route, so a
+// slow shadow pool cannot pile up work; requests beyond it are not mirrored.
+const mirrorMaxInFlight = 100
+
+// Mirror copies a share of a route's requests to a shadow pool. Copies are
+// sent once the primary response is complete and their responses are
+// discarded, so the shadow pool can neither slow down nor fail the primary.
+type Mirror struct {
+	Pool    string
+	Percent float64 // share of requests mirrored, from 0 to 100
+
+	// MaxBodyBytes is the largest request body that is mirrored; larger
+	// requests are not. Bodies are kept in memory as the primary reads them.
+	MaxBodyBytes int64
+}
+
+// MirrorMetrics describes the requests a route has mirrored.
+type MirrorMetrics struct {
+	Pool         string
+	Percent      float64
+	Requests     uint64 // mirrored requests that completed
+	Errors       uint64 // of which got a 5xx status
+	ErrorRate    float64
+	LatencyP50Ms float64
+	LatencyP99Ms float64
+	Skipped      uint64 // sampled requests not mirrored, for their body or too many in flight
+}
+
+type mirror struct {
+	Mirror
+	stats    *splitArm // the shadow pool's requests, kept like a split arm's
+	inFlight chan struct{}
+	skipped  atomic.Uint64
+}
+
+func newMirror(m Mirror, pool *balancer.LoadBalancer) *mirror {
+	if m.MaxBodyBytes <= 0 {
+		m.MaxBodyBytes = defaultMirrorBodyBytes
+	}
+	return &mirror{
+		Mirror:   m,
+		stats:    &splitArm{pool: pool},
+		inFlight: make(chan struct{}, mirrorMaxInFlight),
+	}
+}
+
+// tee decides whether to mirror r. If so, it returns r with its body copied
+// as it is read, and the function that sends the copy once the primary
+// request is done with the body.
+func (m *mirror) tee(r *http.Request) (*http.Request, func()) {
+	if m.Percent <= 0 || rand.Float64()*100 >= m.Percent {
+		return r, nil
+	}
+
+	shadow := r.Clone(context.WithoutCancel(r.Context()))
+	var body *teeBody
+	if r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 {
+		if r.ContentLength > m.MaxBodyBytes {
+			m.skipped.Add(1)
+			return r, nil
+		}
+		body = &teeBody{ReadCloser: r.Body, limit: m.MaxBodyBytes}
+		r = r.WithContext(r.Context())
+		r.Body = body
+	}
+
+	return r, func() {
+		if body != nil {
+			b, ok := body.bytes()
+			if !ok {
+				m.skipped.Add(1)
+				return
+			}
+			shadow.Body = io.NopCloser(bytes.NewReader(b))
+			shadow.ContentLength = int64(len(b))
+		} else {
+			shadow.Body = http.NoBody
+			shadow.ContentLength = 0
+		}
+
+		select {
+		case m.inFlight <- struct{}{}:
+		default:
+			m.skipped.Add(1)
+			return
+		}
+		go m.send(shadow)
+	}
+}
+
+// send forwards r to the shadow pool, discarding the response.
+func (m *mirror) send(r *http.Request) {
+	defer func() { <-m.inFlight }()
+
+	start := time.Now()
+	w := &discardWriter{header: make(http.Header)}
+	m.stats.pool.ServeHTTP(w, r)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	m.stats.record(failed(w.status, w.header), time.Since(start))
+}
+
+func (m *mirror) metrics() MirrorMetrics {
+	s := m.stats.metrics(0)
+	return MirrorMetrics{
+		Pool:         s.Pool,
+		Percent:      m.Percent,
+		Requests:     s.Requests,
+		Errors:       s.Errors,
+		ErrorRate:    s.ErrorRate,
+		LatencyP50Ms: s.LatencyP50Ms,
+		LatencyP99Ms: s.LatencyP99Ms,
+		Skipped:      m.skipped.Load(),
+	}
+}
+
+// Mirrors returns the mirroring metrics of every route that mirrors
+// requests, by route name.
+func (rt *Router) Mirrors() map[string]MirrorMetrics {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	mirrors := make(map[string]MirrorMetrics)
+	for _, cr := range rt.routes {
+		if cr.mirror != nil {
+			mirrors[cr.Name] = cr.mirror.metrics()
+		}
+	}
+	return mirrors
+}
+
+// teeBody keeps a copy of what is read from a request body, up to a limit.
+// The transport may still be reading when the handler finishes, so the copy
+// is guarded by a lock.
+type teeBody struct {
+	io.ReadCloser
+	limit int64
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	eof      bool
+	overflow bool
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// bytes returns the whole body, if it was read to the end within the limit.
+func (b *teeBody) bytes() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.eof || b.overflow {
+		return nil, false
+	}
+	return b.buf.Bytes(), true
+}
+
+// discardWriter is the ResponseWriter of mirrored requests.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= http.StatusOK {
+		w.status = code
+	}
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(b), nil
+}
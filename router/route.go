@@ -0,0 +1,506 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"loadbalancer/balancer"
+	"loadbalancer/listener"
+	sv "loadbalancer/server"
+)
+
+// Match holds the conditions a request must meet for a route to apply. All
+// the conditions that are set must hold; Any adds alternatives of which at
+// least one must hold, so conditions can be combined with AND and OR. Empty
+// fields match everything, and at most one of the path conditions may be set.
+type Match struct {
+	Hosts      []string // exact hosts or wildcards such as "*.example.com"
+	Methods    []string
+	Path       string // the exact path
+	PathPrefix string // the path and any below it, "/api" matching "/api/users" but not "/apiary"
+	PathRegex  string // a regular expression the path must match
+	Headers    []ValueMatch
+	Query      []ValueMatch
+	Cookies    []ValueMatch
+	ClientCert []ValueMatch // "subject", "issuer" or "san" of a verified client certificate
+	Any        []Match
+}
+
+// Client certificate fields ClientCert conditions can check. A "san"
+// condition holds if any SAN, written as "DNS:name", "email:address",
+// "URI:uri" or "IP:address", matches.
+const (
+	CertSubject = "subject"
+	CertIssuer  = "issuer"
+	CertSAN     = "san"
+)
+
+// ValueMatch checks a named header, query parameter, cookie or client
+// certificate field. It matches when the value equals Value or matches
+// Regex; with neither set, the name only has to be present.
+type ValueMatch struct {
+	Name  string
+	Value string
+	Regex string
+}
+
+// Route sends requests that meet its Match to a pool, or splits them
+// across several, optionally rewriting the path first.
+type Route struct {
+	Name  string
+	Match Match
+	Pool  string
+
+	// Splits replaces Pool to divide traffic across pools by weight. The
+	// weights can be changed at runtime with Router.SetWeights.
+	Splits []Split
+
+	// StickyCookie and StickyHeader name a cookie or header whose value keeps
+	// a user on the same side of the split. Requests without one are split
+	// at random.
+	StickyCookie string
+	StickyHeader string
+
+	// Mirror copies a share of the route's requests to a shadow pool.
+	Mirror Mirror
+
+	// StripPrefix removes Match.PathPrefix from the path, and PrefixRewrite
+	// replaces it with something else, so "/api/users" can reach a backend
+	// as "/users" or "/v2/users".
+	StripPrefix   bool
+	PrefixRewrite string
+
+	// RegexRewrite replaces the parts of the path matched by Match.PathRegex;
+	// it may refer to capture groups as $1 or ${name}.
+	RegexRewrite string
+
+	// Timeouts overrides the pool's per-request timeouts.
+	Timeouts sv.Timeouts
+
+	// Deny answers matching requests with 403 Forbidden instead of sending
+	// them to a pool, so earlier routes can admit some clients and a deny
+	// route can turn the rest away.
+	Deny bool
+}
+
+// compiledRoute is a Route ready to be evaluated.
+type compiledRoute struct {
+	Route
+	split  *split
+	mirror *mirror
+	match  *compiledMatch
+}
+
+type compiledMatch struct {
+	Match
+	pathRegex *regexp.Regexp
+	headers   []compiledValue
+	query     []compiledValue
+	cookies   []compiledValue
+	certs     []compiledValue
+	any       []*compiledMatch
+}
+
+type compiledValue struct {
+	ValueMatch
+	regex *regexp.Regexp
+}
+
+func compileRoute(route Route, pools map[string]*balancer.LoadBalancer) (*compiledRoute, error) {
+	m := route.Match
+	if (route.StripPrefix || route.PrefixRewrite != "") && m.PathPrefix == "" && m.Path == "" {
+		return nil, fmt.Errorf("route %s: prefix rewriting needs path or path_prefix", route.Name)
+	}
+	if route.RegexRewrite != "" && m.PathRegex == "" {
+		return nil, fmt.Errorf("route %s: regex_rewrite needs path_regex", route.Name)
+	}
+
+	cm, err := compileMatch(m)
+	if err != nil {
+		return nil, fmt.Errorf("route %s: %v", route.Name, err)
+	}
+	if route.Deny {
+		if route.Pool != "" || len(route.Splits) > 0 || route.Mirror.Pool != "" {
+			return nil, fmt.Errorf("route %s: a deny route cannot have pools", route.Name)
+		}
+		return &compiledRoute{Route: route, match: cm}, nil
+	}
+
+	splits := route.Splits
+	switch {
+	case len(splits) == 0:
+		splits = []Split{{Pool: route.Pool, Weight: 1}}
+	case route.Pool != "":
+		return nil, fmt.Errorf("route %s: only one of pool and splits may be set", route.Name)
+	case route.Name == "":
+		return nil, errors.New("a route with splits needs a name")
+	}
+	arms := make([]*splitArm, len(splits))
+	weights := make([]int, len(splits))
+	for i, s := range splits {
+		pool, ok := pools[s.Pool]
+		if !ok {
+			return nil, fmt.Errorf("route %s: pool %s not found", route.Name, s.Pool)
+		}
+		if slices.ContainsFunc(arms[:i], func(a *splitArm) bool { return a.pool == pool }) {
+			return nil, fmt.Errorf("route %s: pool %s is split to twice", route.Name, s.Pool)
+		}
+		arms[i] = &splitArm{pool: pool}
+		weights[i] = s.Weight
+	}
+	sp, err := newSplit(arms, weights)
+	if err != nil {
+		return nil, fmt.Errorf("route %s: %v", route.Name, err)
+	}
+
+	var mi *mirror
+	if route.Mirror.Pool != "" {
+		pool, ok := pools[route.Mirror.Pool]
+		if !ok {
+			return nil, fmt.Errorf("route %s: mirror pool %s not found", route.Name, route.Mirror.Pool)
+		}
+		if route.Mirror.Percent < 0 || route.Mirror.Percent > 100 {
+			return nil, fmt.Errorf("route %s: mirror percent must be between 0 and 100", route.Name)
+		}
+		mi = newMirror(route.Mirror, pool)
+	}
+
+	return &compiledRoute{Route: route, split: sp, mirror: mi, match: cm}, nil
+}
+
+func compileMatch(m Match) (*compiledMatch, error) {
+	paths := 0
+	for _, p := range []string{m.Path, m.PathPrefix, m.PathRegex} {
+		if p != "" {
+			paths++
+		}
+	}
+	if paths > 1 {
+		return nil, errors.New("only one of path, path_prefix and path_regex may be set")
+	}
+	hosts := make([]string, len(m.Hosts))
+	for i, host := range m.Hosts {
+		if strings.HasPrefix(host, "*") && !strings.HasPrefix(host, "*.") {
+			return nil, fmt.Errorf("invalid wildcard host %s", host)
+		}
+		hosts[i] = strings.ToLower(host)
+	}
+	m.Hosts = hosts
+
+	cm := &compiledMatch{Match: m}
+	var err error
+	if m.PathRegex != "" {
+		if cm.pathRegex, err = regexp.Compile(m.PathRegex); err != nil {
+			return nil, err
+		}
+	}
+	if cm.headers, err = compileValues(m.Headers); err != nil {
+		return nil, err
+	}
+	if cm.query, err = compileValues(m.Query); err != nil {
+		return nil, err
+	}
+	if cm.cookies, err = compileValues(m.Cookies); err != nil {
+		return nil, err
+	}
+	for _, c := range m.ClientCert {
+		if c.Name != CertSubject && c.Name != CertIssuer && c.Name != CertSAN {
+			return nil, fmt.Errorf("unknown client certificate field %q", c.Name)
+		}
+	}
+	if cm.certs, err = compileValues(m.ClientCert); err != nil {
+		return nil, err
+	}
+	for _, alt := range m.Any {
+		compiled, err := compileMatch(alt)
+		if err != nil {
+			return nil, err
+		}
+		cm.any = append(cm.any, compiled)
+	}
+	return cm, nil
+}
+
+func compileValues(values []ValueMatch) ([]compiledValue, error) {
+	compiled := make([]compiledValue, 0, len(values))
+	for _, v := range values {
+		if v.Name == "" {
+			return nil, errors.New("match condition needs a name")
+		}
+		cv := compiledValue{ValueMatch: v}
+		if v.Regex != "" {
+			re, err := regexp.Compile(v.Regex)
+			if err != nil {
+				return nil, err
+			}
+			cv.regex = re
+		}
+		compiled = append(compiled, cv)
+	}
+	return compiled, nil
+}
+
+// matchRequest wraps a request being routed, parsing its query string and
+// cookies at most once however many routes look at them.
+type matchRequest struct {
+	*http.Request
+	host    string
+	query   url.Values
+	cookies map[string]string
+}
+
+func newMatchRequest(r *http.Request) *matchRequest {
+	return &matchRequest{Request: r, host: normalizeHost(r.Host)}
+}
+
+func (mr *matchRequest) queryValues() url.Values {
+	if mr.query == nil {
+		mr.query = mr.URL.Query()
+	}
+	return mr.query
+}
+
+func (mr *matchRequest) cookie(name string) (string, bool) {
+	if mr.cookies == nil {
+		mr.cookies = make(map[string]string)
+		for _, c := range mr.Cookies() {
+			if _, ok := mr.cookies[c.Name]; !ok {
+				mr.cookies[c.Name] = c.Value
+			}
+		}
+	}
+	v, ok := mr.cookies[name]
+	return v, ok
+}
+
+// matches reports whether r meets every condition of m.
+func (m *compiledMatch) matches(r *matchRequest) bool {
+	if len(m.Methods) > 0 && !slices.Contains(m.Methods, r.Method) {
+		return false
+	}
+	if len(m.Hosts) > 0 && !slices.ContainsFunc(m.Hosts, func(pattern string) bool { return matchHost(pattern, r.host) }) {
+		return false
+	}
+
+	path := r.URL.Path
+	switch {
+	case m.Path != "" && path != m.Path:
+		return false
+	case m.PathPrefix != "" && !hasPathPrefix(path, m.PathPrefix):
+		return false
+	case m.pathRegex != nil && !m.pathRegex.MatchString(path):
+		return false
+	}
+
+	for _, h := range m.headers {
+		values, ok := r.Header[http.CanonicalHeaderKey(h.Name)]
+		if !ok || !slices.ContainsFunc(values, h.matches) {
+			return false
+		}
+	}
+	if len(m.query) > 0 {
+		query := r.queryValues()
+		for _, q := range m.query {
+			values, ok := query[q.Name]
+			if !ok || !slices.ContainsFunc(values, q.matches) {
+				return false
+			}
+		}
+	}
+	for _, c := range m.cookies {
+		value, ok := r.cookie(c.Name)
+		if !ok || !c.matches(value) {
+			return false
+		}
+	}
+	if len(m.certs) > 0 {
+		cert := listener.ClientCert(r.Request)
+		if cert == nil {
+			return false
+		}
+		for _, c := range m.certs {
+			var values []string
+			switch c.Name {
+			case CertSubject:
+				values = []string{cert.Subject.String()}
+			case CertIssuer:
+				values = []string{cert.Issuer.String()}
+			case CertSAN:
+				values = listener.SANs(cert)
+			}
+			if !slices.ContainsFunc(values, c.matches) {
+				return false
+			}
+		}
+	}
+
+	if len(m.any) > 0 {
+		return slices.ContainsFunc(m.any, func(alt *compiledMatch) bool { return alt.matches(r) })
+	}
+	return true
+}
+
+func (v *compiledValue) matches(value string) bool {
+	switch {
+	case v.regex != nil:
+		return v.regex.MatchString(value)
+	case v.Value != "":
+		return value == v.Value
+	}
+	return true
+}
+
+// hasPathPrefix reports whether path is prefix or lies below it, matching
+// on whole segments.
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// rewrite returns the path to forward to the pool, given the request's
+// path and its escaped form, as escaped and unescaped paths. Rewriting the
+// escaped path keeps escapes such as %2F in the rest of it intact.
+func (cr *compiledRoute) rewrite(path, escaped string) (string, string) {
+	switch {
+	case cr.match.pathRegex != nil && cr.RegexRewrite != "":
+		if cr.match.pathRegex.MatchString(escaped) {
+			escaped = cr.match.pathRegex.ReplaceAllString(escaped, cr.RegexRewrite)
+		} else {
+			// The pattern only matches unescaped, so the path is escaped anew
+			escaped = (&url.URL{Path: cr.match.pathRegex.ReplaceAllString(path, cr.RegexRewrite)}).EscapedPath()
+		}
+	case cr.StripPrefix || cr.PrefixRewrite != "":
+		prefix := cr.Match.PathPrefix
+		if prefix == "" {
+			prefix = cr.Match.Path
+		}
+		rest := escaped[escapedIndex(escaped, len(prefix)):]
+		if strings.HasSuffix(cr.PrefixRewrite, "/") && strings.HasPrefix(rest, "/") {
+			rest = rest[1:]
+		}
+		escaped = (&url.URL{Path: cr.PrefixRewrite}).EscapedPath() + rest
+	}
+	if !strings.HasPrefix(escaped, "/") {
+		escaped = "/" + escaped
+	}
+	unescaped, err := url.PathUnescape(escaped)
+	if err != nil {
+		return escaped, escaped
+	}
+	return escaped, unescaped
+}
+
+// escapedIndex returns where in escaped, a path with its escapes, the first
+// n bytes of the unescaped path end.
+func escapedIndex(escaped string, n int) int {
+	i := 0
+	for ; n > 0 && i < len(escaped); n-- {
+		if escaped[i] == '%' && i+3 <= len(escaped) {
+			i += 3
+		} else {
+			i++
+		}
+	}
+	return i
+}
+
+// serve sends r to the pool the route's split picks and records the outcome
+// for that arm, then mirrors it if the route says so.
+func (cr *compiledRoute) serve(w http.ResponseWriter, r *http.Request) {
+	if cr.Deny {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	key, sticky := cr.stickyKey(r)
+	arm := cr.split.pick(key, sticky)
+
+	out := cr.apply(r)
+	var mirror func()
+	if cr.mirror != nil {
+		out, mirror = cr.mirror.tee(out)
+	}
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	arm.pool.ServeHTTP(rec, out)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	arm.record(failed(rec.status, rec.Header()), time.Since(start))
+
+	if mirror != nil {
+		mirror()
+	}
+}
+
+// apply returns r as it should be forwarded to the route's pool.
+func (cr *compiledRoute) apply(r *http.Request) *http.Request {
+	ctx := r.Context()
+	if cr.Timeouts != (sv.Timeouts{}) {
+		ctx = sv.WithTimeouts(ctx, cr.Timeouts)
+	}
+	out := r.WithContext(ctx)
+
+	if escaped, path := cr.rewrite(r.URL.Path, r.URL.EscapedPath()); escaped != r.URL.EscapedPath() {
+		u := *r.URL
+		u.Path, u.RawPath = path, escaped
+		out.URL = &u
+	}
+	return out
+}
+
+// normalizeHost strips the port and trailing dot from host and lowercases it.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// matchHost reports whether the normalized host matches pattern, a
+// lowercase exact host or a wildcard such as "*.example.com".
+func matchHost(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == pattern
+}
+
+// AddRoute appends route to the route table. Routes are evaluated in the
+// order they were added, before host-based pool selection. Route names must
+// be unique.
+func (rt *Router) AddRoute(route Route) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if route.Name != "" && slices.ContainsFunc(rt.routes, func(cr *compiledRoute) bool { return cr.Name == route.Name }) {
+		return fmt.Errorf("route %s already exists", route.Name)
+	}
+	cr, err := compileRoute(route, rt.pools)
+	if err != nil {
+		return err
+	}
+	rt.routes = append(rt.routes, cr)
+	return nil
+}
+
+// route returns the first route matching r.
+func (rt *Router) route(r *http.Request) *compiledRoute {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	mr := newMatchRequest(r)
+	for _, cr := range rt.routes {
+		if cr.match.matches(mr) {
+			return cr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"loadbalancer/balancer"
+	"loadbalancer/utils"
+)
+
+// Router sends each request to one of several named pools. The first
+// matching route decides; failing that, the pool is chosen by the request's
+// Host header. Hosts match exactly or, written as "*.example.com", any
+// subdomain of example.com. Requests nothing claims go to the default pool.
+type Router struct {
+	mu          sync.RWMutex
+	routes      []*compiledRoute
+	pools       map[string]*balancer.LoadBalancer
+	hosts       map[string]*balancer.LoadBalancer
+	wildcards   []wildcardHost
+	defaultPool *balancer.LoadBalancer
+	rollouts    map[string]*rollout
+	Logger      *log.Logger
+}
+
+type wildcardHost struct {
+	suffix string // ".example.com"
+	pool   *balancer.LoadBalancer
+}
+
+func NewRouter(logger *log.Logger) *Router {
+	if logger == nil {
+		logger = log.New(io.Discard, "", log.LstdFlags)
+	}
+	return &Router{
+		pools:    make(map[string]*balancer.LoadBalancer),
+		hosts:    make(map[string]*balancer.LoadBalancer),
+		rollouts: make(map[string]*rollout),
+		Logger:   logger,
+	}
+}
+
+// AddPool registers lb under its name and routes the given hosts to it.
+func (rt *Router) AddPool(lb *balancer.LoadBalancer, hosts ...string) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if lb.Name == "" {
+		return errors.New("pool name cannot be empty")
+	}
+	if _, ok := rt.pools[lb.Name]; ok {
+		return fmt.Errorf("pool %s already exists", lb.Name)
+	}
+
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		if suffix, ok := strings.CutPrefix(host, "*"); ok {
+			if !strings.HasPrefix(suffix, ".") {
+				return fmt.Errorf("invalid wildcard host %s", host)
+			}
+			rt.wildcards = append(rt.wildcards, wildcardHost{suffix: suffix, pool: lb})
+			continue
+		}
+		if other, ok := rt.hosts[host]; ok {
+			return fmt.Errorf("host %s is already routed to pool %s", host, other.Name)
+		}
+		rt.hosts[host] = lb
+	}
+
+	rt.pools[lb.Name] = lb
+	rt.Logger.Println(utils.Colorize(fmt.Sprintf("Added pool %s for hosts %v", lb.Name, hosts), utils.GREEN))
+	return nil
+}
+
+// SetDefault makes the named pool receive requests no other pool claims.
+func (rt *Router) SetDefault(name string) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	lb, ok := rt.pools[name]
+	if !ok {
+		return fmt.Errorf("pool %s not found", name)
+	}
+	rt.defaultPool = lb
+	return nil
+}
+
+// Pool returns the pool registered under name, or nil.
+func (rt *Router) Pool(name string) *balancer.LoadBalancer {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.pools[name]
+}
+
+// Pools returns every registered pool by name.
+func (rt *Router) Pools() map[string]*balancer.LoadBalancer {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	pools := make(map[string]*balancer.LoadBalancer, len(rt.pools))
+	for name, lb := range rt.pools {
+		pools[name] = lb
+	}
+	return pools
+}
+
+// PoolForHost returns the pool serving host: an exact match first, then the
+// longest matching wildcard, then the default pool.
+func (rt *Router) PoolForHost(host string) *balancer.LoadBalancer {
+	host = normalizeHost(host)
+
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	if lb, ok := rt.hosts[host]; ok {
+		return lb
+	}
+	var best *wildcardHost
+	for i, w := range rt.wildcards {
+		if strings.HasSuffix(host, w.suffix) && len(host) > len(w.suffix) {
+			if best == nil || len(w.suffix) > len(best.suffix) {
+				best = &rt.wildcards[i]
+			}
+		}
+	}
+	if best != nil {
+		return best.pool
+	}
+	return rt.defaultPool
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if cr := rt.route(r); cr != nil {
+		cr.serve(w, r)
+		return
+	}
+
+	lb := rt.PoolForHost(r.Host)
+	if lb == nil {
+		http.Error(w, "No pool serves host "+r.Host, http.StatusNotFound)
+		return
+	}
+	lb.ServeHTTP(w, r)
+}
+
+// GracefulShutdown stops running rollouts and shuts every pool down.
+func (rt *Router) GracefulShutdown() {
+	rt.stopRollouts()
+	for _, lb := range rt.Pools() {
+		lb.GracefulShutdown()
+	}
+}
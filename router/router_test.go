@@ -0,0 +1,719 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"loadbalancer/balancer"
+)
+
+// newPool creates a pool named name, without retries, backed by a server
+// running handler. A nil handler answers with the name and, for routing
+// tests, the path it was asked for.
+func newPool(t *testing.T, name string, handler http.HandlerFunc) *balancer.LoadBalancer {
+	if handler == nil {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/" {
+				fmt.Fprint(w, name)
+				return
+			}
+			fmt.Fprintf(w, "%s %s", name, r.URL.RequestURI())
+		}
+	}
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+
+	lb := balancer.NewLoadBalancer(nil, "round_robin")
+	lb.Name = name
+	lb.RetryPolicy.MaxRetries = 0
+	if err := lb.AddServer(backend.URL); err != nil {
+		t.Fatalf("failed to add server: %v", err)
+	}
+	return lb
+}
+
+func TestPoolForHost(t *testing.T) {
+	rt := NewRouter(nil)
+	if err := rt.AddPool(newPool(t, "api", nil), "api.example.com"); err != nil {
+		t.Fatalf("failed to add pool: %v", err)
+	}
+	if err := rt.AddPool(newPool(t, "tenants", nil), "*.example.com"); err != nil {
+		t.Fatalf("failed to add pool: %v", err)
+	}
+	if err := rt.AddPool(newPool(t, "eu", nil), "*.eu.example.com"); err != nil {
+		t.Fatalf("failed to add pool: %v", err)
+	}
+
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"api.example.com", "api"},
+		{"API.example.com:8080", "api"},
+		{"acme.example.com", "tenants"},
+		{"acme.eu.example.com", "eu"},
+		{"example.com", ""},
+		{"other.org", ""},
+	}
+	for _, tc := range tests {
+		lb := rt.PoolForHost(tc.host)
+		name := ""
+		if lb != nil {
+			name = lb.Name
+		}
+		if name != tc.expected {
+			t.Errorf("expected host %s to route to '%s', got '%s'", tc.host, tc.expected, name)
+		}
+	}
+
+	if err := rt.SetDefault("api"); err != nil {
+		t.Fatalf("failed to set default pool: %v", err)
+	}
+	if lb := rt.PoolForHost("other.org"); lb == nil || lb.Name != "api" {
+		t.Errorf("expected unknown hosts to fall back to the default pool")
+	}
+}
+
+func TestAddPoolRejectsDuplicates(t *testing.T) {
+	rt := NewRouter(nil)
+	if err := rt.AddPool(newPool(t, "a", nil), "a.example.com"); err != nil {
+		t.Fatalf("failed to add pool: %v", err)
+	}
+	if err := rt.AddPool(newPool(t, "a", nil)); err == nil {
+		t.Errorf("expected duplicate pool name to be rejected")
+	}
+	if err := rt.AddPool(newPool(t, "b", nil), "a.example.com"); err == nil {
+		t.Errorf("expected duplicate host to be rejected")
+	}
+	if err := rt.SetDefault("missing"); err == nil {
+		t.Errorf("expected unknown default pool to be rejected")
+	}
+}
+
+func TestServeHTTPByHost(t *testing.T) {
+	rt := NewRouter(nil)
+	rt.AddPool(newPool(t, "api", nil), "api.example.com")
+	rt.AddPool(newPool(t, "web", nil), "www.example.com")
+
+	for host, expected := range map[string]string{"api.example.com": "api", "www.example.com": "web"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, req)
+		if w.Body.String() != expected {
+			t.Errorf("expected host %s to be served by %s, got '%s'", host, expected, w.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "unknown.org"
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without a default pool, got %d", w.Code)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	rt := NewRouter(nil)
+	for _, name := range []string{"users", "v2", "files", "health", "web"} {
+		if err := rt.AddPool(newPool(t, name, nil)); err != nil {
+			t.Fatalf("failed to add pool: %v", err)
+		}
+	}
+	rt.SetDefault("web")
+
+	routes := []Route{
+		{Name: "health", Match: Match{Path: "/healthz"}, Pool: "health", PrefixRewrite: "/status"},
+		{Name: "users-write", Match: Match{PathPrefix: "/api/users", Methods: []string{http.MethodPost}}, Pool: "v2", PrefixRewrite: "/v2/users"},
+		{Name: "users", Match: Match{PathPrefix: "/api/"}, Pool: "users", StripPrefix: true},
+		{Name: "files", Match: Match{PathRegex: `^/files/(\d+)$`}, Pool: "files", RegexRewrite: "/blobs/$1"},
+	}
+	for _, route := range routes {
+		if err := rt.AddRoute(route); err != nil {
+			t.Fatalf("failed to add route: %v", err)
+		}
+	}
+
+	tests := []struct {
+		method   string
+		path     string
+		expected string
+	}{
+		{http.MethodGet, "/healthz", "health /status"},
+		{http.MethodGet, "/api/users?page=2", "users /users?page=2"},
+		{http.MethodPost, "/api/users/7", "v2 /v2/users/7"},
+		{http.MethodPost, "/api/users", "v2 /v2/users"},
+		{http.MethodPost, "/api/usersearch", "users /usersearch"},
+		{http.MethodGet, "/api/a%2Fb", "users /a%2Fb"},
+		{http.MethodPost, "/api/users/a%3Fb", "v2 /v2/users/a%3Fb"},
+		{http.MethodGet, "/api/%E2%82%AC%2F", "users /%E2%82%AC%2F"},
+		{http.MethodGet, "/apiary", "web /apiary"},
+		{http.MethodGet, "/files/42", "files /blobs/42"},
+		{http.MethodGet, "/files/abc", "web /files/abc"},
+		{http.MethodGet, "/", "web"},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Body.String() != tc.expected {
+			t.Errorf("%s %s: expected '%s', got '%s'", tc.method, tc.path, tc.expected, w.Body.String())
+		}
+	}
+}
+
+func TestAddRouteValidation(t *testing.T) {
+	rt := NewRouter(nil)
+	rt.AddPool(newPool(t, "web", nil))
+
+	invalid := []Route{
+		{Name: "no-pool", Match: Match{PathPrefix: "/"}, Pool: "missing"},
+		{Name: "two-paths", Match: Match{Path: "/a", PathPrefix: "/b"}, Pool: "web"},
+		{Name: "bad-regex", Match: Match{PathRegex: "("}, Pool: "web"},
+		{Name: "strip-without-prefix", Match: Match{PathRegex: "^/a"}, Pool: "web", StripPrefix: true},
+		{Name: "rewrite-without-regex", Match: Match{PathPrefix: "/a"}, Pool: "web", RegexRewrite: "/b"},
+		{Name: "pool-and-splits", Pool: "web", Splits: []Split{{Pool: "web", Weight: 1}}},
+		{Name: "zero-weights", Splits: []Split{{Pool: "web", Weight: 0}}},
+		{Name: "split-twice", Splits: []Split{{Pool: "web", Weight: 1}, {Pool: "web", Weight: 1}}},
+		{Name: "", Splits: []Split{{Pool: "web", Weight: 1}}},
+		{Name: "bad-cert-field", Match: Match{ClientCert: []ValueMatch{{Name: "serial"}}}, Pool: "web"},
+		{Name: "deny-with-pool", Deny: true, Pool: "web"},
+	}
+	for _, route := range invalid {
+		if err := rt.AddRoute(route); err == nil {
+			t.Errorf("expected route %s to be rejected", route.Name)
+		}
+	}
+}
+
+func TestRouteConditions(t *testing.T) {
+	rt := NewRouter(nil)
+	for _, name := range []string{"acme", "beta", "mobile", "web"} {
+		rt.AddPool(newPool(t, name, nil))
+	}
+	rt.SetDefault("web")
+
+	routes := []Route{
+		{Name: "acme", Pool: "acme", Match: Match{Headers: []ValueMatch{{Name: "X-Tenant", Value: "acme"}}}},
+		{Name: "beta", Pool: "beta", Match: Match{Any: []Match{
+			{Query: []ValueMatch{{Name: "beta", Value: "1"}}},
+			{Cookies: []ValueMatch{{Name: "channel", Regex: "^(beta|canary)$"}}},
+		}}},
+		{Name: "mobile", Pool: "mobile", Match: Match{
+			PathPrefix: "/app",
+			Headers:    []ValueMatch{{Name: "X-Device-Id"}},
+		}},
+	}
+	for _, route := range routes {
+		if err := rt.AddRoute(route); err != nil {
+			t.Fatalf("failed to add route: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		header   http.Header
+		cookie   *http.Cookie
+		expected string
+	}{
+		{name: "header exact", path: "/", header: http.Header{"X-Tenant": {"acme"}}, expected: "acme"},
+		{name: "header mismatch", path: "/", header: http.Header{"X-Tenant": {"globex"}}, expected: "web"},
+		{name: "query", path: "/?beta=1", expected: "beta"},
+		{name: "query mismatch", path: "/?beta=0", expected: "web"},
+		{name: "cookie regex", path: "/", cookie: &http.Cookie{Name: "channel", Value: "canary"}, expected: "beta"},
+		{name: "header present and path", path: "/app", header: http.Header{"X-Device-Id": {"42"}}, expected: "mobile /app"},
+		{name: "header present, other path", path: "/web", header: http.Header{"X-Device-Id": {"42"}}, expected: "web /web"},
+		{name: "header missing", path: "/app", expected: "web /app"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		for k, v := range tc.header {
+			req.Header[k] = v
+		}
+		if tc.cookie != nil {
+			req.AddCookie(tc.cookie)
+		}
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, req)
+		if w.Body.String() != tc.expected {
+			t.Errorf("%s: expected '%s', got '%s'", tc.name, tc.expected, w.Body.String())
+		}
+	}
+}
+
+func TestClientCertRoutes(t *testing.T) {
+	rt := NewRouter(nil)
+	rt.AddPool(newPool(t, "admin", nil))
+	rt.AddPool(newPool(t, "web", nil))
+	rt.SetDefault("web")
+
+	routes := []Route{
+		{Name: "admins", Pool: "admin", Match: Match{PathPrefix: "/admin", ClientCert: []ValueMatch{
+			{Name: CertSubject, Regex: "O=Example"},
+			{Name: CertSAN, Value: "URI:spiffe://example.com/ops"},
+		}}},
+		{Name: "others", Deny: true, Match: Match{PathPrefix: "/admin"}},
+		{Name: "services", Pool: "web", Match: Match{ClientCert: []ValueMatch{{Name: CertIssuer, Value: "CN=Internal CA"}}}},
+	}
+	for _, route := range routes {
+		if err := rt.AddRoute(route); err != nil {
+			t.Fatalf("failed to add route: %v", err)
+		}
+	}
+	if err := rt.SetWeights("others", map[string]int{"web": 1}); err == nil {
+		t.Error("expected a deny route to have no weights to set")
+	}
+
+	spiffe, _ := url.Parse("spiffe://example.com/ops")
+	ops := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "alice", Organization: []string{"Example"}},
+		Issuer:  pkix.Name{CommonName: "Internal CA"},
+		URIs:    []*url.URL{spiffe},
+	}
+	intern := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "bob", Organization: []string{"Example"}},
+		Issuer:  pkix.Name{CommonName: "Internal CA"},
+	}
+	tests := []struct {
+		name     string
+		path     string
+		cert     *x509.Certificate
+		verified bool
+		expected int
+		body     string
+	}{
+		{name: "admin", path: "/admin/users", cert: ops, verified: true, expected: http.StatusOK, body: "admin /admin/users"},
+		{name: "missing SAN", path: "/admin/users", cert: intern, verified: true, expected: http.StatusForbidden},
+		{name: "unverified", path: "/admin/users", cert: ops, expected: http.StatusForbidden},
+		{name: "no certificate", path: "/admin/users", expected: http.StatusForbidden},
+		{name: "issuer", path: "/", cert: intern, verified: true, expected: http.StatusOK, body: "web"},
+		{name: "public", path: "/", expected: http.StatusOK, body: "web"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.cert != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tc.cert}}
+			if tc.verified {
+				req.TLS.VerifiedChains = [][]*x509.Certificate{{tc.cert}}
+			}
+		}
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, req)
+		if w.Code != tc.expected || (tc.body != "" && w.Body.String() != tc.body) {
+			t.Errorf("%s: expected %d '%s', got %d '%s'", tc.name, tc.expected, tc.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+// newSplitRouter routes every request through a route splitting between a
+// "stable" and a "canary" pool.
+func newSplitRouter(t *testing.T, stable, canary int, sticky string) *Router {
+	rt := NewRouter(nil)
+	rt.AddPool(newPool(t, "stable", nil))
+	rt.AddPool(newPool(t, "canary", nil))
+	err := rt.AddRoute(Route{
+		Name:         "web",
+		Splits:       []Split{{Pool: "stable", Weight: stable}, {Pool: "canary", Weight: canary}},
+		StickyHeader: sticky,
+	})
+	if err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+	return rt
+}
+
+func TestSplitWeights(t *testing.T) {
+	rt := newSplitRouter(t, 80, 20, "")
+
+	counts := make(map[string]int)
+	for range 1000 {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		counts[w.Body.String()]++
+	}
+	if counts["canary"] < 120 || counts["canary"] > 280 {
+		t.Errorf("expected about 200 of 1000 requests on canary, got %d", counts["canary"])
+	}
+
+	if err := rt.SetWeights("web", map[string]int{"stable": 0, "canary": 100}); err != nil {
+		t.Fatalf("failed to set weights: %v", err)
+	}
+	for range 20 {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Body.String() != "canary" {
+			t.Fatalf("expected every request on canary, got %q", w.Body.String())
+		}
+	}
+
+	splits, err := rt.Splits("web")
+	if err != nil {
+		t.Fatalf("failed to get splits: %v", err)
+	}
+	if splits[1].Pool != "canary" || splits[1].Weight != 100 || splits[1].Requests != uint64(counts["canary"]+20) {
+		t.Errorf("unexpected canary metrics %+v", splits[1])
+	}
+	if splits[0].Requests+splits[1].Requests != 1020 || splits[0].Errors != 0 {
+		t.Errorf("unexpected split metrics %+v", splits)
+	}
+}
+
+func TestSplitGRPCErrors(t *testing.T) {
+	rt := NewRouter(nil)
+	rt.AddPool(newPool(t, "grpc", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		if r.URL.Path == "/trailers-only" {
+			w.Header().Set("Grpc-Status", "14")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.(http.Flusher).Flush()
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", r.URL.Query().Get("status"))
+	}))
+	rt.AddRoute(Route{Name: "grpc", Splits: []Split{{Pool: "grpc", Weight: 1}}})
+
+	// Unavailable and Internal blame the server; NotFound and OK do not
+	for _, target := range []string{"/trailers-only", "/call?status=13", "/call?status=5", "/call?status=0"} {
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		req.Header.Set("Content-Type", "application/grpc")
+		rt.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	splits, err := rt.Splits("grpc")
+	if err != nil {
+		t.Fatalf("failed to get splits: %v", err)
+	}
+	if splits[0].Requests != 4 || splits[0].Errors != 2 {
+		t.Errorf("expected 2 of 4 calls to count as errors, got %+v", splits[0])
+	}
+}
+
+func TestSetWeightsValidation(t *testing.T) {
+	rt := newSplitRouter(t, 95, 5, "")
+
+	invalid := map[string]struct {
+		route   string
+		weights map[string]int
+	}{
+		"unknown route": {"missing", map[string]int{"canary": 10}},
+		"unknown pool":  {"web", map[string]int{"other": 10}},
+		"negative":      {"web", map[string]int{"canary": -1}},
+		"all zero":      {"web", map[string]int{"stable": 0, "canary": 0}},
+	}
+	for name, tc := range invalid {
+		if err := rt.SetWeights(tc.route, tc.weights); err == nil {
+			t.Errorf("%s: expected weights to be rejected", name)
+		}
+	}
+
+	splits, _ := rt.Splits("web")
+	if splits[0].Weight != 95 || splits[1].Weight != 5 {
+		t.Errorf("expected rejected weights to leave 95/5, got %+v", splits)
+	}
+}
+
+func TestStickySplit(t *testing.T) {
+	rt := newSplitRouter(t, 50, 50, "X-User")
+
+	served := func(user string) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-User", user)
+		rt.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	onCanary := make(map[string]bool)
+	for i := range 100 {
+		user := fmt.Sprintf("user-%d", i)
+		first := served(user)
+		for range 3 {
+			if got := served(user); got != first {
+				t.Fatalf("%s moved from %s to %s", user, first, got)
+			}
+		}
+		onCanary[user] = first == "canary"
+	}
+
+	// Growing the canary must not move anyone already on it back
+	rt.SetWeights("web", map[string]int{"stable": 20, "canary": 80})
+	for user, canary := range onCanary {
+		if canary && served(user) != "canary" {
+			t.Errorf("%s left the canary when its weight grew", user)
+		}
+	}
+}
+
+// runRollout drives traffic through a stable/canary split while ro runs and
+// returns the rollout's final status.
+func runRollout(t *testing.T, canary http.HandlerFunc, ro Rollout) RolloutStatus {
+	rt := NewRouter(nil)
+	rt.AddPool(newPool(t, "stable", nil))
+	rt.AddPool(newPool(t, "canary", canary))
+	rt.AddRoute(Route{Name: "web", Splits: []Split{{Pool: "stable", Weight: 100}, {Pool: "canary", Weight: 0}}})
+
+	ended := make(chan RolloutEvent, 1)
+	ro.Route, ro.Baseline, ro.Canary = "web", "stable", "canary"
+	ro.OnEvent = func(e RolloutEvent) {
+		if e.State != RolloutRunning {
+			ended <- e
+		}
+	}
+	if err := rt.StartRollout(ro); err != nil {
+		t.Fatalf("failed to start rollout: %v", err)
+	}
+	if err := rt.StartRollout(ro); err == nil {
+		t.Error("expected a second rollout of the same route to be rejected")
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-ended:
+			return rt.Rollouts()["web"]
+		case <-timeout:
+			t.Fatalf("rollout did not end: %+v", rt.Rollouts()["web"])
+		default:
+			rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}
+	}
+}
+
+func TestRolloutPromotes(t *testing.T) {
+	status := runRollout(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "canary")
+	}, Rollout{Steps: []int{10, 50, 100}, StepInterval: 20 * time.Millisecond, MinRequests: 5})
+
+	if status.State != RolloutPromoted || status.CanaryPercent != 100 {
+		t.Fatalf("expected the canary to be promoted, got %+v", status)
+	}
+	var percents []int
+	for _, e := range status.Events {
+		percents = append(percents, e.CanaryPercent)
+	}
+	if fmt.Sprint(percents) != "[10 50 100 100]" {
+		t.Errorf("expected events for steps 10, 50, 100 and the promotion, got %v", percents)
+	}
+}
+
+func TestRolloutRollsBack(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"errors", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}},
+		{"latency", func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(20 * time.Millisecond)
+			fmt.Fprint(w, "canary")
+		}},
+	}
+	for _, tc := range tests {
+		ro := DefaultRollout()
+		ro.Steps = []int{50, 100}
+		ro.StepInterval = 20 * time.Millisecond
+		ro.MinRequests = 5
+		ro.MaxP99Ratio = 5
+		status := runRollout(t, tc.handler, ro)
+
+		if status.State != RolloutRolledBack || status.CanaryPercent != 0 {
+			t.Errorf("%s: expected the rollout to be rolled back, got %+v", tc.name, status)
+		}
+		if last := status.Events[len(status.Events)-1]; last.Reason == "" {
+			t.Errorf("%s: expected the rollback to give a reason", tc.name)
+		}
+	}
+}
+
+func TestRolloutOwnsSplit(t *testing.T) {
+	rt := NewRouter(nil)
+	for _, name := range []string{"stable", "canary", "legacy"} {
+		rt.AddPool(newPool(t, name, nil))
+	}
+	rt.AddRoute(Route{Name: "web", Splits: []Split{{Pool: "stable", Weight: 80}, {Pool: "canary", Weight: 0}, {Pool: "legacy", Weight: 20}}})
+
+	events := make(chan RolloutEvent, 1)
+	ro := Rollout{Route: "web", Baseline: "stable", Canary: "canary", Steps: []int{10, 100}, StepInterval: time.Hour}
+	ro.OnEvent = func(e RolloutEvent) { events <- e }
+	if err := rt.StartRollout(ro); err != nil {
+		t.Fatalf("failed to start rollout: %v", err)
+	}
+	<-events
+
+	weights := func() string {
+		splits, _ := rt.Splits("web")
+		var w []int
+		for _, s := range splits {
+			w = append(w, s.Weight)
+		}
+		return fmt.Sprint(w)
+	}
+	if got := weights(); got != "[90 10 0]" {
+		t.Errorf("expected the rollout to take the other arm's traffic, got weights %s", got)
+	}
+	if err := rt.SetWeights("web", map[string]int{"stable": 50, "canary": 50}); err == nil {
+		t.Error("expected setting weights during a rollout to be rejected")
+	}
+
+	if err := rt.AbortRollout("web"); err != nil {
+		t.Fatalf("failed to abort rollout: %v", err)
+	}
+	if got := weights(); got != "[100 0 0]" {
+		t.Errorf("expected the abort to send everything to the baseline, got weights %s", got)
+	}
+	if err := rt.SetWeights("web", map[string]int{"stable": 50, "canary": 50}); err != nil {
+		t.Errorf("expected weights to be settable after the rollout: %v", err)
+	}
+}
+
+func TestStartRolloutValidation(t *testing.T) {
+	rt := newSplitRouter(t, 100, 0, "")
+
+	invalid := map[string]Rollout{
+		"no final step":    {Route: "web", Baseline: "stable", Canary: "canary", Steps: []int{5, 50}, StepInterval: time.Second},
+		"decreasing steps": {Route: "web", Baseline: "stable", Canary: "canary", Steps: []int{50, 5, 100}, StepInterval: time.Second},
+		"no interval":      {Route: "web", Baseline: "stable", Canary: "canary", Steps: []int{100}},
+		"unknown route":    {Route: "missing", Baseline: "stable", Canary: "canary", Steps: []int{100}, StepInterval: time.Second},
+		"unknown pool":     {Route: "web", Baseline: "stable", Canary: "other", Steps: []int{100}, StepInterval: time.Second},
+		"same pool":        {Route: "web", Baseline: "stable", Canary: "stable", Steps: []int{100}, StepInterval: time.Second},
+	}
+	for name, ro := range invalid {
+		if err := rt.StartRollout(ro); err == nil {
+			t.Errorf("%s: expected rollout to be rejected", name)
+		}
+	}
+	if err := rt.AbortRollout("web"); err == nil {
+		t.Error("expected aborting without a running rollout to fail")
+	}
+}
+
+func TestMirror(t *testing.T) {
+	shadowBodies := make(chan string, 10)
+	rt := NewRouter(nil)
+	rt.AddPool(newPool(t, "primary", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	rt.AddPool(newPool(t, "shadow", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		time.Sleep(200 * time.Millisecond)
+		shadowBodies <- r.Method + " " + r.URL.Path + " " + string(body)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	err := rt.AddRoute(Route{
+		Name:   "web",
+		Match:  Match{PathPrefix: "/api/"},
+		Pool:   "primary",
+		Mirror: Mirror{Pool: "shadow", Percent: 100, MaxBodyBytes: 8},
+	})
+	if err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader("order")))
+	if w.Code != http.StatusOK || w.Body.String() != "order" {
+		t.Fatalf("expected the primary to echo the body, got %d %q", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("expected the slow shadow not to delay the primary, took %v", elapsed)
+	}
+
+	select {
+	case got := <-shadowBodies:
+		if got != "POST /api/orders order" {
+			t.Errorf("expected the shadow to get a copy of the request, got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("shadow pool never got the mirrored request")
+	}
+
+	// Bodies over the limit are not mirrored
+	w = httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader("a larger order")))
+	if w.Body.String() != "a larger order" {
+		t.Errorf("expected the primary to get the whole body, got %q", w.Body.String())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for rt.Mirrors()["web"].Requests == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	m := rt.Mirrors()["web"]
+	if m.Pool != "shadow" || m.Requests != 1 || m.Errors != 1 || m.Skipped != 1 {
+		t.Errorf("unexpected mirror metrics %+v", m)
+	}
+	if primary := rt.Pool("primary").GetMetrics(); primary.FailedRequests != 0 {
+		t.Errorf("expected shadow errors not to count against the primary, got %+v", primary)
+	}
+}
+
+func TestTeeBody(t *testing.T) {
+	tests := []struct {
+		body  string
+		read  int
+		limit int64
+		ok    bool
+	}{
+		{"hello", 5, 10, true},
+		{"hello", 3, 10, false},
+		{"hello world", 11, 5, false},
+	}
+	for _, tc := range tests {
+		b := &teeBody{ReadCloser: io.NopCloser(strings.NewReader(tc.body)), limit: tc.limit}
+		io.ReadAll(io.LimitReader(b, int64(tc.read)))
+		if tc.read == len(tc.body) {
+			io.ReadAll(b)
+		}
+		got, ok := b.bytes()
+		if ok != tc.ok || (ok && string(got) != tc.body) {
+			t.Errorf("%q read %d with limit %d: got %q, %v", tc.body, tc.read, tc.limit, got, ok)
+		}
+	}
+}
+
+func BenchmarkRouteMatching(b *testing.B) {
+	rt := NewRouter(nil)
+	lb := balancer.NewLoadBalancer(nil, "round_robin")
+	lb.Name = "pool"
+	rt.AddPool(lb)
+
+	// Fifty routes that miss on every kind of condition, then the one that matches
+	for i := 0; i < 10; i++ {
+		rt.AddRoute(Route{Pool: "pool", Match: Match{PathPrefix: fmt.Sprintf("/svc%d/", i)}})
+		rt.AddRoute(Route{Pool: "pool", Match: Match{PathRegex: fmt.Sprintf(`^/items/%d/\d+$`, i)}})
+		rt.AddRoute(Route{Pool: "pool", Match: Match{Headers: []ValueMatch{{Name: "X-Tenant", Value: fmt.Sprintf("tenant%d", i)}}}})
+		rt.AddRoute(Route{Pool: "pool", Match: Match{Query: []ValueMatch{{Name: "variant", Value: fmt.Sprint(i)}}}})
+		rt.AddRoute(Route{Pool: "pool", Match: Match{Cookies: []ValueMatch{{Name: "channel", Regex: fmt.Sprintf("^c%d$", i)}}}})
+	}
+	rt.AddRoute(Route{Pool: "pool", Match: Match{
+		Hosts:      []string{"*.example.com"},
+		PathPrefix: "/api/",
+		Headers:    []ValueMatch{{Name: "X-Tenant", Value: "acme"}},
+	}})
+
+	req := httptest.NewRequest(http.MethodGet, "http://www.example.com/api/users?variant=x", nil)
+	req.Header.Set("X-Tenant", "acme")
+	req.AddCookie(&http.Cookie{Name: "channel", Value: "stable"})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if rt.route(req) == nil {
+			b.Fatal("expected the last route to match")
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package router
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loadbalancer/balancer"
+	sv "loadbalancer/server"
+)
+
+// splitLatencies is how many recent latencies each split arm keeps.
+const splitLatencies = 1000
+
+// Split sends a share of a route's traffic to a pool. Weights are relative,
+// so 95 and 5 send 95% and 5% of requests to their pools.
+type Split struct {
+	Pool   string
+	Weight int
+}
+
+// SplitMetrics describes the traffic one arm of a split has received.
+type SplitMetrics struct {
+	Pool         string
+	Weight       int
+	Requests     uint64
+	Errors       uint64  // responses with a 5xx status or a gRPC status blaming the server
+	ErrorRate    float64 // share of requests that failed
+	LatencyP50Ms float64
+	LatencyP99Ms float64
+}
+
+// splitArm is one of the pools a route sends traffic to.
+type splitArm struct {
+	pool *balancer.LoadBalancer
+
+	mu        sync.Mutex
+	requests  uint64
+	errors    uint64
+	latencies []time.Duration // ring of the latest splitLatencies
+	next      int
+}
+
+func (a *splitArm) record(failed bool, latency time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.requests++
+	if failed {
+		a.errors++
+	}
+	if len(a.latencies) < splitLatencies {
+		a.latencies = append(a.latencies, latency)
+		return
+	}
+	a.latencies[a.next] = latency
+	a.next = (a.next + 1) % splitLatencies
+}
+
+func (a *splitArm) metrics(weight int) SplitMetrics {
+	return a.since(armCount{}, weight)
+}
+
+// armCount marks a point in an arm's traffic, so later metrics can cover
+// only what came after it.
+type armCount struct {
+	requests uint64
+	errors   uint64
+}
+
+func (a *splitArm) count() armCount {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return armCount{requests: a.requests, errors: a.errors}
+}
+
+// since returns the arm's metrics for the requests recorded after c. The
+// latencies cover at most the latest splitLatencies of them.
+func (a *splitArm) since(c armCount, weight int) SplitMetrics {
+	a.mu.Lock()
+	m := SplitMetrics{Pool: a.pool.Name, Weight: weight, Requests: a.requests - c.requests, Errors: a.errors - c.errors}
+	n := int(min(m.Requests, uint64(len(a.latencies))))
+	latencies := make([]time.Duration, 0, n)
+	for k := range n {
+		// The k-th most recent latency
+		i := len(a.latencies) - 1 - k
+		if len(a.latencies) == splitLatencies {
+			i = (a.next - 1 - k + splitLatencies) % splitLatencies
+		}
+		latencies = append(latencies, a.latencies[i])
+	}
+	a.mu.Unlock()
+
+	if m.Requests > 0 {
+		m.ErrorRate = float64(m.Errors) / float64(m.Requests)
+	}
+	slices.Sort(latencies)
+	m.LatencyP50Ms = percentileMs(latencies, 0.50)
+	m.LatencyP99Ms = percentileMs(latencies, 0.99)
+	return m
+}
+
+// percentileMs returns the p-th percentile of sorted in milliseconds.
+func percentileMs(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+// split picks an arm for each request. The weights are swapped as a whole
+// so they can be changed while requests are being routed.
+type split struct {
+	arms    []*splitArm
+	weights atomic.Pointer[[]int]
+	mu      sync.Mutex // serializes weight changes
+}
+
+func newSplit(arms []*splitArm, weights []int) (*split, error) {
+	s := &split{arms: arms}
+	if err := s.setWeights(weights); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *split) setWeights(weights []int) error {
+	total := 0
+	for _, w := range weights {
+		if w < 0 {
+			return fmt.Errorf("negative weight %d", w)
+		}
+		total += w
+	}
+	if total == 0 {
+		return fmt.Errorf("weights must not all be zero")
+	}
+	s.weights.Store(&weights)
+	return nil
+}
+
+// pick returns the arm for a request. With a sticky key the choice is a hash
+// of the key, so a user stays on one side of the split. With two arms, the
+// baseline listed first, and a constant total weight, raising the second
+// arm's weight only ever moves users onto it, never back. With more arms,
+// raising one arm's weight shifts the ranges of the arms after it, so users
+// may move between those.
+func (s *split) pick(key string, sticky bool) *splitArm {
+	if len(s.arms) == 1 {
+		return s.arms[0]
+	}
+	weights := *s.weights.Load()
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+
+	var n int
+	if sticky {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		n = int(h.Sum64() % uint64(total))
+	} else {
+		n = rand.IntN(total)
+	}
+	for i, w := range weights {
+		if n < w {
+			return s.arms[i]
+		}
+		n -= w
+	}
+	return s.arms[len(s.arms)-1]
+}
+
+func (s *split) metrics() []SplitMetrics {
+	weights := *s.weights.Load()
+	m := make([]SplitMetrics, len(s.arms))
+	for i, arm := range s.arms {
+		m[i] = arm.metrics(weights[i])
+	}
+	return m
+}
+
+// stickyKey returns the value that pins r to one side of the route's split.
+func (cr *compiledRoute) stickyKey(r *http.Request) (string, bool) {
+	if cr.StickyCookie != "" {
+		if c, err := r.Cookie(cr.StickyCookie); err == nil && c.Value != "" {
+			return c.Value, true
+		}
+	}
+	if cr.StickyHeader != "" {
+		if v := r.Header.Get(cr.StickyHeader); v != "" {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// SetWeights changes the weights of a route's split while it is serving.
+// Pools the route splits to but weights leaves out keep their weight. While
+// a rollout of the route runs, the rollout owns the weights.
+func (rt *Router) SetWeights(route string, weights map[string]int) error {
+	cr := rt.namedRoute(route)
+	if cr == nil {
+		return fmt.Errorf("route %s not found", route)
+	}
+	if cr.Deny {
+		return fmt.Errorf("route %s denies requests and has no split", route)
+	}
+	if rt.rolloutRunning(route) {
+		return fmt.Errorf("route %s has a rollout running", route)
+	}
+
+	if err := cr.split.set(weights); err != nil {
+		return fmt.Errorf("route %s: %v", route, err)
+	}
+	rt.Logger.Printf("Route %s weights set to %v", route, weights)
+	return nil
+}
+
+// set changes the weights of the named pools.
+func (s *split) set(weights map[string]int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := slices.Clone(*s.weights.Load())
+	for pool, w := range weights {
+		i := slices.IndexFunc(s.arms, func(a *splitArm) bool { return a.pool.Name == pool })
+		if i < 0 {
+			return fmt.Errorf("not split to pool %s", pool)
+		}
+		next[i] = w
+	}
+	return s.setWeights(next)
+}
+
+// Splits returns the metrics of every arm of the named route's split.
+func (rt *Router) Splits(route string) ([]SplitMetrics, error) {
+	cr := rt.namedRoute(route)
+	if cr == nil {
+		return nil, fmt.Errorf("route %s not found", route)
+	}
+	if cr.Deny {
+		return nil, fmt.Errorf("route %s denies requests and has no split", route)
+	}
+	return cr.split.metrics(), nil
+}
+
+// AllSplits returns the split metrics of every route that splits traffic
+// across more than one pool, by route name.
+func (rt *Router) AllSplits() map[string][]SplitMetrics {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	splits := make(map[string][]SplitMetrics)
+	for _, cr := range rt.routes {
+		if !cr.Deny && len(cr.split.arms) > 1 {
+			splits[cr.Name] = cr.split.metrics()
+		}
+	}
+	return splits
+}
+
+// namedRoute returns the route called name, or nil.
+func (rt *Router) namedRoute(name string) *compiledRoute {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	for _, cr := range rt.routes {
+		if cr.Name == name {
+			return cr
+		}
+	}
+	return nil
+}
+
+// failed reports whether a response counts as an error: a 5xx status, or
+// for gRPC calls a grpc-status blaming the server, as the balancer judges
+// servers. h is the header written, into which WriteResponse also puts the
+// trailers, prefixed with http.TrailerPrefix unless they were announced.
+func failed(status int, h http.Header) bool {
+	code, ok := sv.GRPCStatus(h)
+	if !ok {
+		code, ok = sv.GRPCStatus(http.Header{"Grpc-Status": h.Values(http.TrailerPrefix + "Grpc-Status")})
+	}
+	if ok {
+		return sv.IsGRPCServerError(code)
+	}
+	return status >= http.StatusInternalServerError
+}
+
+// statusRecorder remembers the status written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 && code >= http.StatusOK {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer to flush.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	errBodySuperseded    = errors.New("request body superseded by a later attempt")
+	errBodyNotReplayable = errors.New("request body can no longer be replayed")
+)
+
+// ReplayBody wraps a client request body so that every attempt at proxying
+// the request can read it from the start. Unlike reading the whole body up
+// front, bytes are passed on as they arrive, so streaming uploads and
+// bidirectional gRPC calls are not held back.
+//
+// Only the first limit bytes are kept for replaying. Past them, or once
+// Commit is called, the body is passed through to the current attempt
+// alone and no more is kept.
+type ReplayBody struct {
+	readMu sync.Mutex // serializes reads from src
+
+	mu         sync.Mutex // protects the fields below
+	src        io.ReadCloser
+	limit      int
+	buf        []byte
+	start      int  // offset in the body of buf[0]
+	replayable bool // buf holds the body from its start
+	err        error
+	current    *replayReader
+}
+
+// NewReplayBody wraps src, keeping up to limit bytes for replaying. Zero
+// means no limit.
+func NewReplayBody(src io.ReadCloser, limit int) *ReplayBody {
+	return &ReplayBody{src: src, limit: limit, replayable: true}
+}
+
+// Reader returns a reader positioned at the start of the body. Readers handed
+// out earlier stop returning data, so a stale attempt cannot steal bytes meant
+// for the next one. Once the body is no longer replayable, the reader fails.
+func (b *ReplayBody) Reader() io.ReadCloser {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := &replayReader{body: b}
+	b.current = r
+	return r
+}
+
+// Replayable reports whether a new attempt can still read the body from the
+// start.
+func (b *ReplayBody) Replayable() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.replayable
+}
+
+// Commit stops keeping the body for later attempts, once the current one is
+// the last. What is buffered is freed as the current attempt reads it.
+func (b *ReplayBody) Commit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.replayable = false
+	b.trim()
+}
+
+// trim drops the buffered bytes that no attempt can read anymore. b.mu must
+// be held.
+func (b *ReplayBody) trim() {
+	if b.replayable {
+		return
+	}
+	pos := b.start + len(b.buf)
+	if b.current != nil {
+		pos = max(b.current.pos, b.start)
+	}
+	if pos >= b.start+len(b.buf) {
+		b.buf = nil
+	} else {
+		b.buf = b.buf[pos-b.start:]
+	}
+	b.start = pos
+}
+
+// Close closes the underlying client body.
+func (b *ReplayBody) Close() error {
+	return b.src.Close()
+}
+
+// Read reads from a fresh attempt. It lets a ReplayBody stand in for the
+// original request body.
+func (b *ReplayBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	r := b.current
+	b.mu.Unlock()
+	if r == nil {
+		r = b.Reader().(*replayReader)
+	}
+	return r.Read(p)
+}
+
+type replayReader struct {
+	body *ReplayBody
+	pos  int
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	b := r.body
+	if n, ok, err := r.readBuffered(p); ok {
+		return n, err
+	}
+
+	// Nothing buffered past our position: pull more from the client. The
+	// state lock is released meanwhile so a retry can still get a Reader.
+	b.readMu.Lock()
+	defer b.readMu.Unlock()
+	if n, ok, err := r.readBuffered(p); ok {
+		return n, err
+	}
+	chunk := make([]byte, len(p))
+	n, err := b.src.Read(chunk)
+
+	b.mu.Lock()
+	if b.replayable && b.limit > 0 && b.start+len(b.buf)+n > b.limit {
+		b.replayable = false
+	}
+	b.buf = append(b.buf, chunk[:n]...)
+	b.err = err
+	b.mu.Unlock()
+
+	n, _, err = r.readBuffered(p)
+	return n, err
+}
+
+// readBuffered serves p from bytes already read from the client. ok is false
+// when the client has to be read from first.
+func (r *replayReader) readBuffered(p []byte) (n int, ok bool, err error) {
+	b := r.body
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.current != r {
+		return 0, true, errBodySuperseded
+	}
+	if r.pos < b.start {
+		return 0, true, errBodyNotReplayable
+	}
+	if r.pos < b.start+len(b.buf) {
+		n = copy(p, b.buf[r.pos-b.start:])
+		r.pos += n
+		b.trim()
+		return n, true, nil
+	}
+	if b.err != nil {
+		return 0, true, b.err
+	}
+	return 0, false, nil
+}
+
+// Close is a no-op: the transport closes request bodies when an attempt ends,
+// but the client's body must stay open for a retry.
+func (r *replayReader) Close() error {
+	return nil
+}
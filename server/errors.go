@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Kinds of failure reported by Forward.
+const (
+	FailureUnhealthy = "unhealthy"       // the server was out of rotation, nothing was sent
+	FailureConnect   = "connect-failure" // the connection could not be established
+	FailureTimeout   = "timeout"         // the server did not answer in time
+	FailureOther     = "other"           // the request failed after it may have reached the server
+	FailureCanceled  = "canceled"        // the caller gave up on the request, such as a lost hedge
+)
+
+var errRequestTimeout = errors.New("request timed out")
+
+// ForwardError is returned by Forward when no response was received.
+type ForwardError struct {
+	Kind string
+	Err  error
+}
+
+func (e *ForwardError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+func (e *ForwardError) Unwrap() error {
+	return e.Err
+}
+
+// FailureKind returns the kind of a Forward error, or FailureOther if err
+// did not come from Forward.
+func FailureKind(err error) string {
+	var fe *ForwardError
+	if errors.As(err, &fe) {
+		return fe.Kind
+	}
+	return FailureOther
+}
+
+// classify works out why a round trip made with ctx failed, telling the
+// server's failures apart from the caller giving up, which FailureCanceled
+// marks.
+func classify(ctx context.Context, err error) string {
+	switch context.Cause(ctx) {
+	case errRequestTimeout, errResponseHeaderTimeout, errIdleBodyTimeout:
+		return FailureTimeout
+	}
+	if ctx.Err() != nil {
+		return FailureCanceled // not the server's fault
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return FailureConnect
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return FailureTimeout
+	}
+	return FailureOther
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flushInterval returns the interval to use when copying resp to the client.
+// Server-Sent Events and responses of unknown length are flushed immediately,
+// matching httputil.ReverseProxy.
+func (s *Server) flushInterval(resp *http.Response) time.Duration {
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if contentType == "text/event-stream" {
+		return -1
+	}
+	if resp.ContentLength == -1 {
+		return -1
+	}
+	return s.Options.FlushInterval
+}
+
+// clientWriteError is a failure to write the response to the client, which
+// says nothing about the server it came from.
+type clientWriteError struct {
+	err error
+}
+
+func (e *clientWriteError) Error() string { return e.err.Error() }
+func (e *clientWriteError) Unwrap() error { return e.err }
+
+// isStream reports whether resp is a long-lived stream, which Timeouts.Total
+// lets run once it starts: Server-Sent Events, gRPC calls, which bound
+// themselves with their own deadlines, and the content types listed in
+// Options.StreamContentTypes.
+func (s *Server) isStream(resp *http.Response) bool {
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if contentType == "text/event-stream" || strings.HasPrefix(contentType, "application/grpc") {
+		return true
+	}
+	return contentType != "" && slices.Contains(s.Options.StreamContentTypes, contentType)
+}
+
+// copyResponse copies src to w, flushing according to interval. A zero
+// interval never flushes, a negative one flushes after every write. Errors
+// writing to w are returned as a *clientWriteError.
+func copyResponse(w http.ResponseWriter, src io.Reader, interval time.Duration) error {
+	var dst io.Writer = w
+	if interval != 0 {
+		mlw := &maxLatencyWriter{
+			dst:     w,
+			flush:   http.NewResponseController(w).Flush,
+			latency: interval,
+		}
+		defer mlw.stop()
+
+		// Send the headers right away so the client sees the stream start.
+		mlw.flushPending = true
+		mlw.t = time.AfterFunc(0, mlw.delayedFlush)
+
+		dst = mlw
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return &clientWriteError{err: werr}
+			}
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
+
+// maxLatencyWriter flushes writes to dst at most latency after they happen.
+type maxLatencyWriter struct {
+	dst     io.Writer
+	flush   func() error
+	latency time.Duration // non-zero; negative means to flush immediately
+
+	mu           sync.Mutex // protects t, flushPending, and dst.Write
+	t            *time.Timer
+	flushPending bool
+}
+
+func (m *maxLatencyWriter) Write(p []byte) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err = m.dst.Write(p)
+	if m.latency < 0 {
+		m.flush()
+		return
+	}
+	if m.flushPending {
+		return
+	}
+	if m.t == nil {
+		m.t = time.AfterFunc(m.latency, m.delayedFlush)
+	} else {
+		m.t.Reset(m.latency)
+	}
+	m.flushPending = true
+	return
+}
+
+func (m *maxLatencyWriter) delayedFlush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.flushPending { // if stop was called but AfterFunc already started this goroutine
+		return
+	}
+	m.flush()
+	m.flushPending = false
+}
+
+func (m *maxLatencyWriter) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flushPending = false
+	if m.t != nil {
+		m.t.Stop()
+	}
+}
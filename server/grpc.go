@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes the balancer cares about.
+const (
+	GRPCUnknown           = 2
+	GRPCDeadlineExceeded  = 4
+	GRPCResourceExhausted = 8
+	GRPCInternal          = 13
+	GRPCUnavailable       = 14
+	GRPCDataLoss          = 15
+)
+
+// IsGRPC reports whether r is a gRPC call.
+func IsGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// GRPCStatus returns the grpc-status carried by h, if any.
+func GRPCStatus(h http.Header) (int, bool) {
+	v := h.Get("Grpc-Status")
+	if v == "" {
+		return 0, false
+	}
+	code, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false
+	}
+	return code, true
+}
+
+// IsGRPCServerError reports whether code points at a fault in the backend
+// rather than in the call itself.
+func IsGRPCServerError(code int) bool {
+	switch code {
+	case GRPCUnknown, GRPCDeadlineExceeded, GRPCInternal, GRPCUnavailable, GRPCDataLoss:
+		return true
+	}
+	return false
+}
+
+// WriteGRPCError answers a gRPC call with a trailers-only response.
+func WriteGRPCError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", message)
+	w.WriteHeader(http.StatusOK)
+}
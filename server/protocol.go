@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Upstream protocols, selected per backend by the scheme of its URL.
+const (
+	ProtocolHTTP1 = "http/1.1" // http://  plain HTTP/1.1
+	ProtocolHTTPS = "https"    // https:// TLS, HTTP/2 or HTTP/1.1 negotiated by ALPN
+	ProtocolH2C   = "h2c"      // h2c://   cleartext HTTP/2 with prior knowledge; Upgrade: h2c is not attempted
+	ProtocolTCP   = "tcp"      // tcp://   raw TCP, proxied with ProxyConn
+	ProtocolUDP   = "udp"      // udp://   UDP datagrams, relayed with DialUDP
+	ProtocolUnix  = "unix"     // unix://  plain HTTP/1.1 over a Unix socket, as in unix:///run/app.sock
+)
+
+// parseProtocol returns the upstream protocol for a backend URL along with
+// the URL to send requests to, and the path of its socket for Unix socket
+// backends.
+func parseProtocol(url string) (protocol, target, socket string) {
+	switch {
+	case strings.HasPrefix(url, "unix://"):
+		// The host is a placeholder, as connections go to the socket
+		return ProtocolUnix, "http://localhost", strings.TrimPrefix(url, "unix://")
+	case strings.HasPrefix(url, "h2c://"):
+		return ProtocolH2C, "http://" + strings.TrimPrefix(url, "h2c://"), ""
+	case strings.HasPrefix(url, "tcp://"):
+		return ProtocolTCP, strings.TrimPrefix(url, "tcp://"), ""
+	case strings.HasPrefix(url, "udp://"):
+		return ProtocolUDP, strings.TrimPrefix(url, "udp://"), ""
+	case strings.HasPrefix(url, "https://"):
+		return ProtocolHTTPS, url, ""
+	default:
+		return ProtocolHTTP1, url, ""
+	}
+}
+
+// ValidateURL reports whether rawURL is a usable server URL, so that bad
+// configuration is caught before servers are added.
+func ValidateURL(rawURL string) error {
+	if strings.HasPrefix(rawURL, "h2c+upgrade://") {
+		// Named on its own, since an unknown scheme error would not say
+		// that the mode itself is missing
+		return fmt.Errorf("invalid server URL %q: upgrading to h2c is not supported upstream; use h2c:// if the server accepts HTTP/2 with prior knowledge, or http://", rawURL)
+	}
+	protocol, target, socket := parseProtocol(rawURL)
+	switch protocol {
+	case ProtocolTCP, ProtocolUDP:
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return fmt.Errorf("invalid server URL %q: %v", rawURL, err)
+		}
+		return nil
+	case ProtocolUnix:
+		if socket == "" {
+			return fmt.Errorf("invalid server URL %q: no socket path", rawURL)
+		}
+	}
+	if _, err := parseBase(target); err != nil {
+		return fmt.Errorf("invalid server URL %q: %v", rawURL, err)
+	}
+	return nil
+}
+
+// parseBase parses the URL of an HTTP server. Requests are sent below its
+// path, with its query added to theirs.
+func parseBase(target string) (*url.URL, error) {
+	base, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", base.Scheme)
+	}
+	if base.Host == "" {
+		return nil, errors.New("no host")
+	}
+	base.Fragment, base.RawFragment = "", ""
+	return base, nil
+}
+
+// joinURL returns the URL a request for u is sent to below base:
+// "http://host/app" and "/users?id=1" make "http://host/app/users?id=1",
+// with a single slash where the paths meet.
+func joinURL(base, u *url.URL) *url.URL {
+	target := *base
+	target.Path, target.RawPath = joinURLPath(base, u)
+	if base.RawQuery == "" || u.RawQuery == "" {
+		target.RawQuery = base.RawQuery + u.RawQuery
+	} else {
+		target.RawQuery = base.RawQuery + "&" + u.RawQuery
+	}
+	return &target
+}
+
+// joinURLPath joins the paths of a and b, keeping their escaping.
+func joinURLPath(a, b *url.URL) (path, rawPath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return joinSlash(a.Path, b.Path), ""
+	}
+	escaped := joinSlash(a.EscapedPath(), b.EscapedPath())
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return joinSlash(a.Path, b.Path), ""
+	}
+	return path, escaped
+}
+
+func joinSlash(a, b string) string {
+	aSlash, bSlash := strings.HasSuffix(a, "/"), strings.HasPrefix(b, "/")
+	switch {
+	case aSlash && bSlash:
+		return a + b[1:]
+	case !aSlash && !bSlash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// newTransport builds the round tripper used to reach a backend speaking
+// protocol, at socket for Unix socket backends. Connection-level timeouts
+// and TLS settings are applied here; the rest are handled per request.
+func newTransport(protocol, socket string, timeouts Timeouts, tlsConfig *tls.Config) http.RoundTripper {
+	dialer := &net.Dialer{Timeout: timeouts.Connect, KeepAlive: 30 * time.Second}
+	switch protocol {
+	case ProtocolH2C:
+		// Connections start with the HTTP/2 preface. There is no fallback to
+		// HTTP/1.1, nor an upgrade from it, as http2.Transport has neither.
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		}
+	default:
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = dialer.DialContext
+		if protocol == ProtocolUnix {
+			transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socket)
+			}
+		}
+		transport.TLSHandshakeTimeout = timeouts.TLSHandshake
+		transport.ForceAttemptHTTP2 = protocol == ProtocolHTTPS
+		if tlsConfig != nil {
+			transport.TLSClientConfig = tlsConfig.Clone()
+		}
+		return transport
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// rewriteResponse maps the server's own address in redirects, and the
+// domains and paths of the cookies it sets, to what the client sees, as
+// configured in Options.
+func (s *Server) rewriteResponse(r *http.Request, resp *http.Response) {
+	if s.Options.RewriteRedirects && s.base != nil {
+		for _, name := range []string{"Location", "Content-Location"} {
+			if location := resp.Header.Get(name); location != "" {
+				resp.Header.Set(name, s.rewriteLocation(r, location))
+			}
+		}
+	}
+
+	if len(s.Options.CookieDomains) == 0 && len(s.Options.CookiePaths) == 0 {
+		return
+	}
+	var cookies []string
+	for _, cookie := range resp.Header.Values("Set-Cookie") {
+		cookies = append(cookies, s.rewriteCookie(cookie))
+	}
+	if cookies != nil {
+		resp.Header["Set-Cookie"] = cookies
+	}
+}
+
+// rewriteLocation maps a location on the server to the host and scheme the
+// client used, leaving out the server's base path. Locations elsewhere are
+// kept as they are.
+func (s *Server) rewriteLocation(r *http.Request, location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	if u.IsAbs() || u.Host != "" {
+		host := strings.ToLower(u.Host)
+		if host != strings.ToLower(s.base.Host) && host != strings.ToLower(s.Options.HostRewrite) {
+			return location
+		}
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+		u.Host = r.Host
+	} else if !strings.HasPrefix(u.Path, "/") {
+		return location // relative to the request's path, which the client shares
+	}
+
+	basePath := strings.TrimSuffix(s.base.Path, "/")
+	if basePath != "" && (u.Path == basePath || strings.HasPrefix(u.Path, basePath+"/")) {
+		u.Path = strings.TrimPrefix(u.Path, basePath)
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		u.RawPath = ""
+	}
+	return u.String()
+}
+
+// rewriteCookie rewrites the Domain and Path attributes of a Set-Cookie
+// value, keeping the rest as sent.
+func (s *Server) rewriteCookie(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	kept := parts[:1]
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch {
+		case strings.EqualFold(name, "Domain"):
+			domain, ok := lookupFold(s.Options.CookieDomains, strings.TrimPrefix(value, "."))
+			if !ok {
+				break
+			}
+			if domain == "" {
+				continue // scoped to the host the client used
+			}
+			part = " Domain=" + domain
+		case strings.EqualFold(name, "Path"):
+			if path, ok := rewriteCookiePath(s.Options.CookiePaths, value); ok {
+				part = " Path=" + path
+			}
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, ";")
+}
+
+// lookupFold looks up key in m, ignoring case.
+func lookupFold(m map[string]string, key string) (string, bool) {
+	for k, v := range m {
+		if strings.EqualFold(strings.TrimPrefix(k, "."), key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// rewriteCookiePath replaces the longest prefix of path found in prefixes.
+func rewriteCookiePath(prefixes map[string]string, path string) (string, bool) {
+	longest := ""
+	found := false
+	for prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) && (!found || len(prefix) > len(longest)) {
+			longest, found = prefix, true
+		}
+	}
+	if !found {
+		return path, false
+	}
+	to, rest := prefixes[longest], strings.TrimPrefix(path, longest)
+	if strings.HasSuffix(to, "/") && strings.HasPrefix(rest, "/") {
+		rest = rest[1:]
+	}
+	if to+rest == "" {
+		return "/", true
+	}
+	return to + rest, true
+}
@@ -1,99 +1,377 @@
 package server
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"loadbalancer/utils"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
 
 const HealthyKey = ":healthy"
 
+// requestTimeout is the default bound on a proxied request. Streams (see
+// Server.isStream) are exempt once their headers have arrived.
+const requestTimeout = 30 * time.Second
+
+// Options holds the proxy settings a Server shares with the rest of its pool.
+type Options struct {
+	// FlushInterval is how often the response body is flushed to the client
+	// while it is being copied. Zero disables periodic flushing and a negative
+	// value flushes after every write. Server-Sent Events and responses of
+	// unknown length are always flushed immediately.
+	FlushInterval time.Duration
+
+	// StreamContentTypes lists media types, such as "application/x-ndjson",
+	// of long-lived streams that Timeouts.Total lets run once their
+	// headers arrive, as it does Server-Sent Events and gRPC calls.
+	StreamContentTypes []string
+
+	// OutlierFailures is the number of consecutive failed calls after which
+	// the server is taken out of rotation until it passes a health check.
+	// Transport errors, 5xx responses and gRPC server-side statuses count as
+	// failures. Zero disables ejection.
+	OutlierFailures int
+
+	// Timeouts bounds each request to the server. Requests can override the
+	// per-request timeouts with WithTimeouts.
+	Timeouts Timeouts
+
+	// HealthCheckPath is requested by CheckHealth; "/" when empty.
+	HealthCheckPath string
+
+	// DeadlineHeader, when set, names a request header that tells the server
+	// how many milliseconds are left before the balancer gives up.
+	DeadlineHeader string
+
+	// IdleTimeout closes TCP connections proxied with ProxyConn once neither
+	// side has sent anything for this long. Zero disables it.
+	IdleTimeout time.Duration
+
+	// ProxyProtocol, 1 or 2, makes ProxyConn start each connection with a
+	// PROXY protocol header of that version, so servers see the original
+	// client. Zero sends none.
+	ProxyProtocol int
+
+	// PreserveHost sends servers the Host header the client sent, rather
+	// than the host of their URL. HostRewrite, when set, is sent instead of
+	// either.
+	PreserveHost bool
+	HostRewrite  string
+
+	// RewriteRedirects maps Location and Content-Location headers pointing
+	// at the server back to the host and scheme the client used, without
+	// the server's base path, like nginx's proxy_redirect.
+	RewriteRedirects bool
+
+	// CookieDomains and CookiePaths rewrite the cookies the server sets,
+	// like nginx's proxy_cookie_domain and proxy_cookie_path. CookieDomains
+	// maps domains to their replacements, an empty one removing the
+	// attribute so the cookie belongs to the host the client used.
+	// CookiePaths maps path prefixes to their replacements.
+	CookieDomains map[string]string
+	CookiePaths   map[string]string
+
+	// TLS configures connections to https:// servers: the CAs trusted, a
+	// client certificate for mutual TLS and the SNI server name. Go's
+	// defaults are used when nil.
+	TLS *tls.Config
+}
+
+// DefaultOptions returns the options a server gets when none are configured.
+func DefaultOptions() Options {
+	return Options{Timeouts: DefaultTimeouts()}
+}
+
 type Server struct {
 	URL           string
+	Protocol      string
 	Load          int
 	Healthy       bool
 	LastChecked   time.Time
 	ResponseTimes []time.Duration
+	Options       Options
 	mu            sync.RWMutex
 	logger        *log.Logger
+	target        string
+	socket        string
+	base          *url.URL
+	client        *http.Client
+	clientOnce    sync.Once
+
+	consecutiveFailures int
+	conns               map[net.Conn]struct{} // open proxied connections, for CloseConns
 }
 
-func NewServer(url string, logger *log.Logger) *Server {
-	return &Server{
-		URL:     url,
-		Healthy: true,
-		logger:  logger,
+// NewServer creates a server for rawURL, which should have been checked
+// with ValidateURL. An HTTP server with an invalid URL is never healthy.
+func NewServer(rawURL string, logger *log.Logger) *Server {
+	protocol, target, socket := parseProtocol(rawURL)
+	s := &Server{
+		URL:      rawURL,
+		Protocol: protocol,
+		Healthy:  true,
+		Options:  DefaultOptions(),
+		logger:   logger,
+		target:   target,
+		socket:   socket,
+	}
+	if protocol != ProtocolTCP && protocol != ProtocolUDP {
+		base, err := parseBase(target)
+		if err != nil {
+			logger.Println(utils.Colorize(fmt.Sprintf("Server %s has an invalid URL: %v", rawURL, err), utils.RED))
+			s.Healthy = false
+		}
+		s.base = base
 	}
+	return s
+}
+
+// httpClient returns the client for this server, built from its options on
+// first use.
+func (s *Server) httpClient() *http.Client {
+	s.clientOnce.Do(func() {
+		s.client = &http.Client{
+			Transport: newTransport(s.Protocol, s.socket, s.Options.Timeouts, s.Options.TLS),
+			// Redirects are the client's to follow
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+	})
+	return s.client
 }
 
 func (s *Server) HandleRequest(w http.ResponseWriter, r *http.Request) error {
+	resp, err := s.Forward(r)
+	if err != nil {
+		return err
+	}
+	return s.WriteResponse(w, resp)
+}
+
+// Forward sends r to the server and returns the response without writing
+// anything to the client, so the caller can still decide to retry. The
+// server's load is held until the response body is closed.
+func (s *Server) Forward(r *http.Request) (*http.Response, error) {
 	s.mu.Lock()
 	if !s.Healthy {
 		s.mu.Unlock()
-		return fmt.Errorf("server %s is not healthy", s.URL)
+		return nil, &ForwardError{Kind: FailureUnhealthy, Err: fmt.Errorf("server %s is not healthy", s.URL)}
 	}
 	s.Load++
 	s.mu.Unlock()
 
-	defer func() {
+	start := time.Now()
+	timeouts := s.timeouts(r.Context())
+
+	// Bound the request with timers rather than http.Client.Timeout so that
+	// long-lived streams can be let through once they start. Cancelling the
+	// client's request cancels this one too.
+	ctx, cancel := context.WithCancelCause(r.Context())
+	totalTimer := stopTimer(timeouts.Total, func() { cancel(errRequestTimeout) })
+	headerTimer := stopTimer(timeouts.ResponseHeader, func() { cancel(errResponseHeaderTimeout) })
+	done := func() {
+		totalTimer.Stop()
+		headerTimer.Stop()
+		cancel(nil)
 		s.mu.Lock()
 		s.Load--
 		s.mu.Unlock()
-	}()
-
-	start := time.Now()
-
-	// Create new request with timeout
-	client := &http.Client{
-		Timeout: 30 * time.Second,
 	}
 
-	var bodyBytes []byte
-	var err error
-	if r.Body != nil {
-		bodyBytes, err = io.ReadAll(r.Body)
-		if err != nil {
-			return fmt.Errorf("failed to read request body: %v", err)
+	var body io.ReadCloser
+	if r.ContentLength != 0 && r.Body != nil && r.Body != http.NoBody {
+		body = r.Body
+		if rb, ok := body.(*ReplayBody); ok {
+			body = rb.Reader()
 		}
-		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 	}
 
-	req, err := http.NewRequest(r.Method, s.URL+r.RequestURI, bytes.NewBuffer(bodyBytes))
+	req, err := http.NewRequestWithContext(ctx, r.Method, joinURL(s.base, r.URL).String(), body)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+		done()
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.ContentLength = r.ContentLength
+	if body == nil {
+		req.ContentLength = 0
 	}
 
 	// Copy headers
 	utils.CopyHeaders(req.Header, r.Header)
+	utils.RemoveHopHeaders(req.Header)
+	switch {
+	case s.Options.HostRewrite != "":
+		req.Host = s.Options.HostRewrite
+	case s.Options.PreserveHost:
+		req.Host = r.Host
+	}
+	setForwardedHeaders(req, r)
+	if len(r.Trailer) > 0 {
+		req.Trailer = r.Trailer
+	}
+	if s.Options.DeadlineHeader != "" {
+		if left, ok := remaining(ctx, start, timeouts.Total); ok {
+			req.Header.Set(s.Options.DeadlineHeader, left)
+		}
+	}
 
 	// Execute request
-	resp, err := client.Do(req)
+	resp, err := s.httpClient().Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to execute request: %v", err)
+		kind := classify(ctx, err)
+		done()
+		if kind != FailureCanceled {
+			s.recordResult(false)
+		}
+		return nil, &ForwardError{Kind: kind, Err: fmt.Errorf("failed to execute request: %v", err)}
 	}
-	defer resp.Body.Close()
+	headerTimer.Stop()
+	s.rewriteResponse(r, resp)
+	if timeouts.IdleBody > 0 {
+		resp.Body = newIdleTimeoutBody(resp.Body, timeouts.IdleBody, cancel)
+	}
+	resp.Body = &responseBody{ReadCloser: resp.Body, done: done}
 
 	// Update response times
 	duration := time.Since(start)
 	s.updateResponseTime(duration)
 
-	// Copy response
+	if s.isStream(resp) {
+		totalTimer.Stop()
+	}
+
+	// gRPC calls report their outcome in trailers, which are only known once
+	// the body has been copied; trailers-only responses are settled here.
+	if code, ok := GRPCStatus(resp.Header); ok {
+		s.recordResult(!IsGRPCServerError(code))
+	} else if !IsGRPC(r) {
+		s.recordResult(resp.StatusCode < http.StatusInternalServerError)
+	}
+
+	return resp, nil
+}
+
+// setForwardedHeaders tells the server whom r came from, appending the
+// client's address to any X-Forwarded-For chain proxies in front have set,
+// and over which scheme.
+func setForwardedHeaders(req, r *http.Request) {
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+}
+
+// WriteResponse copies resp, trailers included, to w and closes its body.
+func (s *Server) WriteResponse(w http.ResponseWriter, resp *http.Response) error {
+	defer resp.Body.Close()
+
 	utils.CopyHeaders(w.Header(), resp.Header)
+	utils.RemoveHopHeaders(w.Header())
+
+	// Announce the trailers we know about before the header is written
+	announced := len(resp.Trailer)
+	if announced > 0 {
+		keys := make([]string, 0, announced)
+		for k := range resp.Trailer {
+			keys = append(keys, k)
+		}
+		w.Header().Add("Trailer", strings.Join(keys, ", "))
+	}
+
 	w.WriteHeader(resp.StatusCode)
 
-	_, err = io.Copy(w, resp.Body)
+	err := copyResponse(w, resp.Body, s.flushInterval(resp))
 	if err != nil {
+		// Only a body the server broke off counts against it, not a client
+		// that went away or could not be written to
+		var writeErr *clientWriteError
+		if !errors.As(err, &writeErr) && (resp.Request == nil || classify(resp.Request.Context(), err) != FailureCanceled) {
+			s.recordResult(false)
+		}
 		return fmt.Errorf("failed to copy response: %v", err)
 	}
 
+	// Trailers that were not announced up front, as is usual for gRPC, are
+	// sent with the TrailerPrefix.
+	if len(resp.Trailer) == announced {
+		utils.CopyHeaders(w.Header(), resp.Trailer)
+	} else {
+		for k, vv := range resp.Trailer {
+			for _, v := range vv {
+				w.Header().Add(http.TrailerPrefix+k, v)
+			}
+		}
+	}
+	if len(resp.Trailer) > 0 {
+		http.NewResponseController(w).Flush()
+	}
+
+	if _, ok := GRPCStatus(resp.Header); !ok {
+		if code, ok := GRPCStatus(resp.Trailer); ok {
+			s.recordResult(!IsGRPCServerError(code))
+		}
+	}
+
 	return nil
 }
 
+// recordResult tracks consecutive failures and takes the server out of
+// rotation once Options.OutlierFailures is reached. The next successful
+// health check brings it back.
+func (s *Server) recordResult(ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ok {
+		s.consecutiveFailures = 0
+		return
+	}
+	s.consecutiveFailures++
+	if s.Options.OutlierFailures > 0 && s.consecutiveFailures >= s.Options.OutlierFailures && s.Healthy {
+		s.Healthy = false
+		s.logger.Println(utils.Colorize(fmt.Sprintf("Server %s ejected after %d consecutive failures", s.URL, s.consecutiveFailures), utils.RED))
+	}
+}
+
+// stopTimer runs f after d, or never if d is zero.
+func stopTimer(d time.Duration, f func()) *time.Timer {
+	t := time.AfterFunc(d, f)
+	if d <= 0 {
+		t.Stop()
+	}
+	return t
+}
+
+// responseBody releases the server's hold on a request once the response
+// body is closed.
+type responseBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *responseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
 func (s *Server) updateResponseTime(duration time.Duration) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -104,6 +382,28 @@ func (s *Server) updateResponseTime(duration time.Duration) {
 	}
 }
 
+// CurrentLoad returns the number of requests and connections the server is
+// handling.
+func (s *Server) CurrentLoad() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Load
+}
+
+// IsHealthy reports whether the server is in rotation.
+func (s *Server) IsHealthy() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Healthy
+}
+
+// RecentResponseTimes returns a copy of the latest response times.
+func (s *Server) RecentResponseTimes() []time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.ResponseTimes)
+}
+
 func PrintState(url string, load int, finished bool) string {
 	if finished {
 		return fmt.Sprintf("Finished request on server %s. Current load: %s\n", utils.Colorize(url, utils.GREEN), utils.Colorize(fmt.Sprintf("%d", load), utils.YELLOW))
@@ -112,14 +412,43 @@ func PrintState(url string, load int, finished bool) string {
 }
 
 func (s *Server) CheckHealth() {
-	resp, err := http.Get(s.URL + "/")
+	path := s.Options.HealthCheckPath
+	if path == "" {
+		path = "/"
+	}
+	healthy := false
+	switch s.Protocol {
+	case ProtocolTCP:
+		// A TCP server is healthy if it accepts connections
+		conn, err := net.DialTimeout("tcp", s.target, s.Options.Timeouts.Connect)
+		if err == nil {
+			conn.Close()
+			healthy = true
+		}
+	default:
+		if s.base == nil {
+			break
+		}
+		u, err := url.Parse(path)
+		if err != nil {
+			break
+		}
+		// Health checks follow redirects to the page that answers
+		client := *s.httpClient()
+		client.CheckRedirect = nil
+		if resp, err := client.Get(joinURL(s.base, u).String()); err == nil {
+			resp.Body.Close()
+			healthy = resp.StatusCode == http.StatusOK
+		}
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if err != nil || resp.StatusCode != http.StatusOK {
+	if !healthy {
 		s.Healthy = false
 		s.logger.Println(utils.Colorize(fmt.Sprintf("Server %s is unhealthy\n", s.URL), utils.RED))
 	} else {
 		s.Healthy = true
+		s.consecutiveFailures = 0
 	}
 }
@@ -1,13 +1,31 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"loadbalancer/internal/testcert"
+	"loadbalancer/listener"
 )
 
 const URL = "http://example.com"
@@ -88,3 +106,715 @@ func TestCheckHealth(t *testing.T) {
 		t.Errorf("expected server to be healthy")
 	}
 }
+
+func TestHandleRequestStreamsEvents(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	server := NewServer(backend.URL, log.New(io.Discard, "", log.LstdFlags))
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.HandleRequest(w, r)
+	}))
+	defer front.Close()
+
+	resp, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatalf("failed to get stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	line := make(chan string, 1)
+	go func() {
+		s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- s
+	}()
+
+	select {
+	case got := <-line:
+		if got != "data: first\n" {
+			t.Errorf("expected first event, got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event was not flushed to the client")
+	}
+}
+
+func TestHandleRequestH2C(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}), &http2.Server{}))
+	defer backend.Close()
+
+	server := NewServer(strings.Replace(backend.URL, "http://", "h2c://", 1), log.New(io.Discard, "", log.LstdFlags))
+	if server.Protocol != ProtocolH2C {
+		t.Fatalf("expected protocol %s, got %s", ProtocolH2C, server.Protocol)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	if err := server.HandleRequest(w, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if w.Body.String() != "HTTP/2.0" {
+		t.Errorf("expected backend to see HTTP/2.0, got %s", w.Body.String())
+	}
+}
+
+func TestHandleRequestUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	backend := &httptest.Server{
+		Listener: ln,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.URL.RequestURI())
+		})},
+	}
+	backend.Start()
+	defer backend.Close()
+
+	server := NewServer("unix://"+socket, log.New(io.Discard, "", log.LstdFlags))
+	if server.Protocol != ProtocolUnix {
+		t.Fatalf("expected protocol %s, got %s", ProtocolUnix, server.Protocol)
+	}
+	server.Healthy = false
+	server.CheckHealth()
+	if !server.Healthy {
+		t.Error("expected the server to pass health checks over its socket")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users?id=1", nil)
+	w := httptest.NewRecorder()
+	if err := server.HandleRequest(w, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if w.Body.String() != "/api/users?id=1" {
+		t.Errorf("expected the path to be forwarded, got %s", w.Body.String())
+	}
+}
+
+func TestJoinURL(t *testing.T) {
+	tests := []struct {
+		base, request, want string
+	}{
+		{base: "http://host:8000", request: "/users?id=1", want: "http://host:8000/users?id=1"},
+		{base: "http://host:8000/app", request: "/users", want: "http://host:8000/app/users"},
+		{base: "http://host:8000/app/", request: "/users", want: "http://host:8000/app/users"},
+		{base: "http://host:8000/app/", request: "/", want: "http://host:8000/app/"},
+		{base: "http://host:8000/app?key=k", request: "/users?id=1", want: "http://host:8000/app/users?key=k&id=1"},
+		{base: "http://host:8000/app", request: "/a%2Fb", want: "http://host:8000/app/a%2Fb"},
+	}
+	for _, tc := range tests {
+		base, err := parseBase(tc.base)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", tc.base, err)
+		}
+		u, err := url.ParseRequestURI(tc.request)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", tc.request, err)
+		}
+		if got := joinURL(base, u).String(); got != tc.want {
+			t.Errorf("%s + %s: expected %s, got %s", tc.base, tc.request, tc.want, got)
+		}
+	}
+
+	for _, invalid := range []string{"http://", "localhost:8000", "ftp://host", "http://host:port", "tcp://host", "unix://", "h2c+upgrade://host:8080"} {
+		if err := ValidateURL(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestHandleRequestHost(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Host, r.URL.RequestURI())
+	}))
+	defer backend.Close()
+	backendHost := strings.TrimPrefix(backend.URL, "http://")
+
+	tests := []struct {
+		name         string
+		preserveHost bool
+		hostRewrite  string
+		want         string
+	}{
+		{name: "server's host", want: backendHost + "/app/users"},
+		{name: "preserved", preserveHost: true, want: "example.com/app/users"},
+		{name: "rewritten", hostRewrite: "internal.example.com", want: "internal.example.com/app/users"},
+	}
+	for _, tc := range tests {
+		server := NewServer(backend.URL+"/app/", log.New(io.Discard, "", log.LstdFlags))
+		server.Options.PreserveHost = tc.preserveHost
+		server.Options.HostRewrite = tc.hostRewrite
+
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/users", nil)
+		w := httptest.NewRecorder()
+		if err := server.HandleRequest(w, req); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if w.Body.String() != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.want, w.Body.String())
+		}
+	}
+}
+
+func TestHandleRequestForwardedFor(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Forwarded-For"), " ", r.Header.Get("X-Forwarded-Proto"))
+	}))
+	defer backend.Close()
+	server := NewServer(backend.URL, log.New(io.Discard, "", log.LstdFlags))
+
+	// The client reaches the proxy through an L4 balancer that sends a PROXY
+	// protocol header, so its address comes from there
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	policy := listener.DefaultProxyProtocol()
+	policy.Trusted, _ = listener.ParseCIDRs([]string{"127.0.0.1"})
+	front := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.HandleRequest(w, r)
+	})}
+	go front.Serve(policy.Listen(ln))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "PROXY TCP4 203.0.113.7 192.0.2.1 56324 80\r\n")
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nX-Forwarded-For: 198.51.100.1\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if want := "198.51.100.1, 203.0.113.7 http"; string(body) != want {
+		t.Errorf("expected %q, got %q", want, body)
+	}
+}
+
+func TestRewriteResponse(t *testing.T) {
+	var location string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", location)
+		w.Header().Add("Set-Cookie", "session=abc; Domain=.app.internal; Path=/app/account; HttpOnly")
+		w.Header().Add("Set-Cookie", "theme=dark; Domain=example.org; Path=/")
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer backend.Close()
+
+	server := NewServer(backend.URL+"/app", log.New(io.Discard, "", log.LstdFlags))
+	server.Options.RewriteRedirects = true
+	server.Options.CookieDomains = map[string]string{"app.internal": "", "example.org": "example.com"}
+	server.Options.CookiePaths = map[string]string{"/app": "/", "/app/account": "/account"}
+
+	tests := []struct {
+		location string
+		tls      bool
+		want     string
+	}{
+		{location: backend.URL + "/app/login?next=%2F", want: "http://example.com/login?next=%2F"},
+		{location: backend.URL + "/app", tls: true, want: "https://example.com/"},
+		{location: backend.URL + "/other", want: "http://example.com/other"},
+		{location: "/app/login", want: "/login"},
+		{location: "login", want: "login"},
+		{location: "https://sso.example.org/auth", want: "https://sso.example.org/auth"},
+	}
+	for _, tc := range tests {
+		location = tc.location
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		if tc.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		if err := server.HandleRequest(w, req); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := w.Header().Get("Location"); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.location, tc.want, got)
+		}
+
+		cookies := w.Header().Values("Set-Cookie")
+		want := []string{"session=abc; Path=/account; HttpOnly", "theme=dark; Domain=example.com; Path=/"}
+		if !slices.Equal(cookies, want) {
+			t.Errorf("expected cookies %q, got %q", want, cookies)
+		}
+	}
+}
+
+func TestHandleRequestMutualTLS(t *testing.T) {
+	cert := testcert.New(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "balancer"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert.Leaf)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.TLS.ServerName, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	backend.Config.ErrorLog = logger
+	backend.StartTLS()
+	defer backend.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(backend.Certificate())
+	forward := func(tlsConfig *tls.Config) (string, error) {
+		server := NewServer(backend.URL, logger)
+		server.Options.TLS = tlsConfig
+		w := httptest.NewRecorder()
+		err := server.HandleRequest(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Body.String(), err
+	}
+
+	if _, err := forward(nil); err == nil {
+		t.Error("expected the backend's certificate to be rejected without its CA")
+	}
+	if _, err := forward(&tls.Config{RootCAs: rootCAs}); err == nil {
+		t.Error("expected the backend to reject a client without a certificate")
+	}
+	got, err := forward(&tls.Config{RootCAs: rootCAs, Certificates: []tls.Certificate{cert}, ServerName: "example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "example.com balancer" {
+		t.Errorf("expected the SNI override and client certificate to reach the backend, got %q", got)
+	}
+	if _, err := forward(&tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}); err != nil {
+		t.Errorf("expected insecure_skip_verify to accept any certificate, got %v", err)
+	}
+}
+
+func TestHandleRequestPropagatesTrailers(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer backend.Close()
+
+	server := NewServer(strings.Replace(backend.URL, "http://", "h2c://", 1), log.New(io.Discard, "", log.LstdFlags))
+
+	req := httptest.NewRequest(http.MethodPost, "/pkg.Service/Method", strings.NewReader("\x00\x00\x00\x00\x00"))
+	req.Header.Set("Content-Type", "application/grpc")
+	w := httptest.NewRecorder()
+	if err := server.HandleRequest(w, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := w.Result().Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("expected grpc-status trailer 0, got '%s'", got)
+	}
+}
+
+func TestReplayBody(t *testing.T) {
+	body := NewReplayBody(io.NopCloser(strings.NewReader("payload")), 0)
+
+	first := body.Reader()
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(first, buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	second := body.Reader()
+	if _, err := first.Read(buf); err == nil {
+		t.Errorf("expected superseded reader to fail")
+	}
+	data, err := io.ReadAll(second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(data) != "payload" {
+		t.Errorf("expected replayed body 'payload', got '%s'", data)
+	}
+}
+
+func TestReplayBodyLimit(t *testing.T) {
+	body := NewReplayBody(io.NopCloser(strings.NewReader("payload")), 4)
+	first := body.Reader()
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(first, buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !body.Replayable() {
+		t.Fatal("expected a body within the limit to be replayable")
+	}
+
+	// Past the limit the current attempt still gets the whole body
+	rest, err := io.ReadAll(first)
+	if err != nil || string(buf)+string(rest) != "payload" {
+		t.Fatalf("expected the rest of the body, got %q, %v", rest, err)
+	}
+	if body.Replayable() {
+		t.Error("expected a body past the limit not to be replayable")
+	}
+	if _, err := body.Reader().Read(buf); err == nil {
+		t.Error("expected a new attempt to fail")
+	}
+	if len(body.buf) != 0 {
+		t.Errorf("expected nothing to stay buffered, got %q", body.buf)
+	}
+}
+
+func TestReplayBodyCommit(t *testing.T) {
+	body := NewReplayBody(io.NopCloser(strings.NewReader("payload")), 0)
+	io.ReadAll(body.Reader())
+
+	// A retry commits while the body is still buffered
+	second := body.Reader()
+	buf := make([]byte, 3)
+	io.ReadFull(second, buf)
+	body.Commit()
+	if len(body.buf) != 4 {
+		t.Errorf("expected only the unread bytes to stay buffered, got %q", body.buf)
+	}
+	rest, err := io.ReadAll(second)
+	if err != nil || string(buf)+string(rest) != "payload" {
+		t.Fatalf("expected the rest of the body, got %q, %v", rest, err)
+	}
+	if len(body.buf) != 0 || body.Replayable() {
+		t.Errorf("expected the buffer to be dropped once read, got %q", body.buf)
+	}
+}
+
+func TestOutlierEjection(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+
+	server := NewServer(backend.URL, log.New(io.Discard, "", log.LstdFlags))
+	server.Options.OutlierFailures = 2
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if err := server.HandleRequest(httptest.NewRecorder(), req); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if server.Healthy {
+		t.Errorf("expected server to be ejected after consecutive failures")
+	}
+}
+
+// failingWriter fails every write of the body, as for a client that has
+// gone away.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestClientFailuresKeepServerHealthy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		w.Write([]byte("part"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+
+	server := NewServer(backend.URL, log.New(io.Discard, "", log.LstdFlags))
+	server.Options.OutlierFailures = 1
+
+	// The client gives up before the response headers arrive
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := server.Forward(httptest.NewRequest(http.MethodGet, "/slow", nil).WithContext(ctx))
+	if FailureKind(err) != FailureCanceled {
+		t.Errorf("expected a cancelled request, got %v", err)
+	}
+
+	// The client goes away while the body streams
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.HandleRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)); err == nil {
+		t.Error("expected copying the body to fail")
+	}
+
+	// The response cannot be written to the client
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	w := failingWriter{httptest.NewRecorder()}
+	if err := server.HandleRequest(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)); err == nil {
+		t.Error("expected writing to the client to fail")
+	}
+
+	if !server.IsHealthy() {
+		t.Error("expected failures on the client's side not to eject the server")
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer backend.Close()
+
+	server := NewServer(backend.URL, log.New(io.Discard, "", log.LstdFlags))
+	server.Options.Timeouts.ResponseHeader = 50 * time.Millisecond
+
+	_, err := server.Forward(httptest.NewRequest(http.MethodGet, "/", nil))
+	if FailureKind(err) != FailureTimeout {
+		t.Errorf("expected a timeout failure, got %v", err)
+	}
+
+	// A per-request override takes precedence over the pool's timeouts
+	server.Options.Timeouts.ResponseHeader = 0
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(WithTimeouts(req.Context(), Timeouts{ResponseHeader: 50 * time.Millisecond}))
+	_, err = server.Forward(req)
+	if FailureKind(err) != FailureTimeout {
+		t.Errorf("expected a timeout failure from the override, got %v", err)
+	}
+}
+
+func TestIdleBodyTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		w.Write([]byte("part"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer backend.Close()
+
+	server := NewServer(backend.URL, log.New(io.Discard, "", log.LstdFlags))
+	server.Options.Timeouts.IdleBody = 50 * time.Millisecond
+
+	start := time.Now()
+	err := server.HandleRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if err == nil {
+		t.Errorf("expected the stalled body to fail")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("expected the idle timeout to cut the body short")
+	}
+}
+
+func TestTotalTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Header().Set("Content-Length", "8")
+		w.Write([]byte("part"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+		w.Write([]byte("rest"))
+	}))
+	defer backend.Close()
+
+	server := NewServer(backend.URL, log.New(io.Discard, "", log.LstdFlags))
+	server.Options.FlushInterval = -1
+	server.Options.Timeouts.Total = 100 * time.Millisecond
+	server.Options.StreamContentTypes = []string{"application/x-ndjson"}
+
+	tests := []struct {
+		contentType string
+		completes   bool
+	}{
+		{"application/octet-stream", false}, // flushing every write does not make a stream
+		{"text/event-stream", true},
+		{"application/x-ndjson", true},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		err := server.HandleRequest(w, httptest.NewRequest(http.MethodGet, "/?type="+url.QueryEscape(tc.contentType), nil))
+		if completes := err == nil && w.Body.String() == "partrest"; completes != tc.completes {
+			t.Errorf("%s: expected completion %v, got body %q and error %v", tc.contentType, tc.completes, w.Body.String(), err)
+		}
+	}
+}
+
+func TestIdleBodyTimeoutSlowReader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "8")
+		w.Write([]byte("part"))
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("rest"))
+	}))
+	defer backend.Close()
+
+	server := NewServer(backend.URL, log.New(io.Discard, "", log.LstdFlags))
+	server.Options.Timeouts.IdleBody = 50 * time.Millisecond
+
+	resp, err := server.Forward(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Time the reader spends elsewhere between reads is not idle time
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	time.Sleep(190 * time.Millisecond)
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil || string(rest) != "rest" {
+		t.Errorf("expected the rest of the body after a slow reader, got %q, %v", rest, err)
+	}
+}
+
+func TestDeadlineHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Request-Deadline"))
+	}))
+	defer backend.Close()
+
+	server := NewServer(backend.URL, log.New(io.Discard, "", log.LstdFlags))
+	server.Options.DeadlineHeader = "X-Request-Deadline"
+	server.Options.Timeouts.Total = 2 * time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	w := httptest.NewRecorder()
+	if err := server.HandleRequest(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	left, err := strconv.Atoi(w.Body.String())
+	if err != nil || left <= 0 || left > 1000 {
+		t.Errorf("expected the client's 1s deadline to be propagated, got '%s'", w.Body.String())
+	}
+}
+
+func TestProxyConnIdleTimeout(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	server := NewServer("tcp://"+backend.Addr().String(), log.New(io.Discard, "", log.LstdFlags))
+	if server.Protocol != ProtocolTCP {
+		t.Fatalf("expected protocol %s, got %s", ProtocolTCP, server.Protocol)
+	}
+	server.CheckHealth()
+	if !server.Healthy {
+		t.Error("expected a server accepting connections to be healthy")
+	}
+	server.Options.IdleTimeout = 100 * time.Millisecond
+
+	client, proxied := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- server.ProxyConn(proxied) }()
+
+	// Activity keeps the connection open past the idle timeout
+	buf := make([]byte, 4)
+	for range 3 {
+		time.Sleep(60 * time.Millisecond)
+		io.WriteString(client, "ping")
+		if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("expected an echo, got %q, %v", buf, err)
+		}
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errIdleConnTimeout) {
+			t.Errorf("expected an idle timeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the idle connection to be closed")
+	}
+	if server.CurrentLoad() != 0 {
+		t.Errorf("expected the load to be released, got %d", server.CurrentLoad())
+	}
+
+	backend.Close()
+	server.CheckHealth()
+	if server.Healthy {
+		t.Error("expected a server refusing connections to be unhealthy")
+	}
+}
+
+func TestProxyConnSendsProxyHeader(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer backend.Close()
+	headers := make(chan string, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		headers <- line
+	}()
+
+	server := NewServer("tcp://"+backend.Addr().String(), log.New(io.Discard, "", log.LstdFlags))
+	server.Options.ProxyProtocol = 1
+
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer front.Close()
+	client, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+	proxied, err := front.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	go server.ProxyConn(proxied)
+
+	src, dst := client.LocalAddr().(*net.TCPAddr), client.RemoteAddr().(*net.TCPAddr)
+	want := fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP, dst.IP, src.Port, dst.Port)
+	select {
+	case got := <-headers:
+		if got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the server to get a PROXY protocol header")
+	}
+}
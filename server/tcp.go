@@ -0,0 +1,149 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"loadbalancer/listener"
+)
+
+var errIdleConnTimeout = errors.New("connection idle for too long")
+
+// ProxyConn connects client to the server and copies bytes both ways until
+// both sides are done, or until neither has sent anything for
+// Options.IdleTimeout. The server's load is held for as long as the
+// connection lasts. The caller closes client.
+func (s *Server) ProxyConn(client net.Conn) error {
+	s.mu.Lock()
+	if !s.Healthy {
+		s.mu.Unlock()
+		return &ForwardError{Kind: FailureUnhealthy, Err: fmt.Errorf("server %s is not healthy", s.URL)}
+	}
+	s.Load++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.Load--
+		s.mu.Unlock()
+	}()
+
+	upstream, err := net.DialTimeout("tcp", s.target, s.Options.Timeouts.Connect)
+	if err != nil {
+		s.recordResult(false)
+		return &ForwardError{Kind: FailureConnect, Err: fmt.Errorf("failed to connect: %v", err)}
+	}
+	defer upstream.Close()
+	s.recordResult(true)
+	defer s.trackConn(upstream)()
+
+	if s.Options.ProxyProtocol != 0 {
+		header, err := listener.ProxyHeader{
+			Version:     s.Options.ProxyProtocol,
+			Source:      client.RemoteAddr(),
+			Destination: client.LocalAddr(),
+		}.Marshal()
+		if err != nil {
+			return err
+		}
+		if _, err := upstream.Write(header); err != nil {
+			return fmt.Errorf("failed to send PROXY protocol header: %v", err)
+		}
+	}
+
+	return splice(client, upstream, s.Options.IdleTimeout)
+}
+
+// trackConn registers conn, so CloseConns can close it, until the returned
+// function is called.
+func (s *Server) trackConn(conn net.Conn) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	return func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}
+}
+
+// CloseConns closes the TCP connections proxied with ProxyConn and the
+// sockets opened with DialUDP that are still open, for a server that must
+// go without waiting for its clients. HTTP requests are not affected.
+func (s *Server) CloseConns() {
+	s.mu.Lock()
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// splice copies a to b and b to a. When one side finishes sending, the other
+// is told so with a half-close where the connection supports it. Both
+// connections are closed when either fails or they stay idle for longer
+// than idle; zero disables the idle timeout.
+func splice(a, b net.Conn, idle time.Duration) error {
+	var once sync.Once
+	var spliceErr error
+	abort := func(err error) {
+		once.Do(func() {
+			spliceErr = err
+			a.Close()
+			b.Close()
+		})
+	}
+
+	var timer *time.Timer
+	if idle > 0 {
+		timer = time.AfterFunc(idle, func() { abort(errIdleConnTimeout) })
+		defer timer.Stop()
+	}
+
+	var wg sync.WaitGroup
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, &activityReader{Reader: src, timer: timer, idle: idle})
+		if err != nil {
+			abort(err)
+			return
+		}
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			abort(nil)
+		}
+	}
+	wg.Add(2)
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+
+	// Keep the idle timer from aborting once both sides are done
+	once.Do(func() {})
+	return spliceErr
+}
+
+// activityReader resets the idle timer whenever data arrives.
+type activityReader struct {
+	io.Reader
+	timer *time.Timer
+	idle  time.Duration
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 && r.timer != nil {
+		r.timer.Reset(r.idle)
+	}
+	return n, err
+}
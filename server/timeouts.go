@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+)
+
+var (
+	errResponseHeaderTimeout = errors.New("timed out waiting for response headers")
+	errIdleBodyTimeout       = errors.New("response body idle for too long")
+)
+
+// Timeouts bounds the phases of a proxied request. Zero disables a timeout.
+type Timeouts struct {
+	Connect        time.Duration // establishing the TCP connection
+	TLSHandshake   time.Duration // the TLS handshake on a new connection
+	ResponseHeader time.Duration // from sending the request until the response headers arrive
+	IdleBody       time.Duration // the longest pause while reading the response body
+	Total          time.Duration // the whole exchange; streams (see Options.StreamContentTypes) are exempt once they start
+}
+
+// DefaultTimeouts matches the transport defaults and the 30s request limit.
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Connect:      30 * time.Second,
+		TLSHandshake: 10 * time.Second,
+		Total:        requestTimeout,
+	}
+}
+
+// merge returns t with the non-zero fields of override applied.
+func (t Timeouts) merge(override Timeouts) Timeouts {
+	if override.Connect > 0 {
+		t.Connect = override.Connect
+	}
+	if override.TLSHandshake > 0 {
+		t.TLSHandshake = override.TLSHandshake
+	}
+	if override.ResponseHeader > 0 {
+		t.ResponseHeader = override.ResponseHeader
+	}
+	if override.IdleBody > 0 {
+		t.IdleBody = override.IdleBody
+	}
+	if override.Total > 0 {
+		t.Total = override.Total
+	}
+	return t
+}
+
+type timeoutsKey struct{}
+
+// WithTimeouts returns a context whose requests use the per-request
+// timeouts of t (ResponseHeader, IdleBody and Total) instead of the pool's.
+// Connections are shared across requests, so Connect and TLSHandshake
+// always come from the pool.
+func WithTimeouts(ctx context.Context, t Timeouts) context.Context {
+	return context.WithValue(ctx, timeoutsKey{}, t)
+}
+
+// timeouts returns the timeouts that apply to a request made with ctx.
+func (s *Server) timeouts(ctx context.Context) Timeouts {
+	t := s.Options.Timeouts
+	if override, ok := ctx.Value(timeoutsKey{}).(Timeouts); ok {
+		override.Connect, override.TLSHandshake = 0, 0
+		t = t.merge(override)
+	}
+	return t
+}
+
+// remaining formats the time left until the request's deadline for the
+// deadline header, in milliseconds.
+func remaining(ctx context.Context, start time.Time, total time.Duration) (string, bool) {
+	deadline, ok := ctx.Deadline()
+	if total > 0 && (!ok || start.Add(total).Before(deadline)) {
+		deadline, ok = start.Add(total), true
+	}
+	if !ok {
+		return "", false
+	}
+	return strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 0), 10), true
+}
+
+// idleTimeoutBody cancels the request when a read from the body stalls for
+// longer than timeout. Only time spent waiting in Read counts, so a reader
+// that is slow to come back, such as one writing to a slow client, is not
+// cut off.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelCauseFunc) *idleTimeoutBody {
+	timer := time.AfterFunc(timeout, func() { cancel(errIdleBodyTimeout) })
+	timer.Stop() // armed by each Read
+	return &idleTimeoutBody{
+		ReadCloser: body,
+		timer:      timer,
+		timeout:    timeout,
+	}
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	defer b.timer.Stop()
+	return b.ReadCloser.Read(p)
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// DialUDP opens a socket to the server for relaying one client's datagrams.
+// The server's load is held until the socket is closed.
+func (s *Server) DialUDP() (net.Conn, error) {
+	s.mu.Lock()
+	if !s.Healthy {
+		s.mu.Unlock()
+		return nil, &ForwardError{Kind: FailureUnhealthy, Err: fmt.Errorf("server %s is not healthy", s.URL)}
+	}
+	s.Load++
+	s.mu.Unlock()
+	release := func() {
+		s.mu.Lock()
+		s.Load--
+		s.mu.Unlock()
+	}
+
+	conn, err := net.Dial("udp", s.target)
+	if err != nil {
+		release()
+		return nil, &ForwardError{Kind: FailureConnect, Err: fmt.Errorf("failed to open socket: %v", err)}
+	}
+	c := &udpConn{Conn: conn}
+	untrack := s.trackConn(c)
+	c.done = func() {
+		untrack()
+		release()
+	}
+	return c, nil
+}
+
+// udpConn releases the server's hold on a relayed client once closed.
+type udpConn struct {
+	net.Conn
+	once sync.Once
+	done func()
+}
+
+func (c *udpConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.done)
+	return err
+}
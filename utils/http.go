@@ -1,6 +1,22 @@
 package utils
 
-import "net/http"
+import (
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are connection-specific and must not be forwarded by a proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
 
 // CopyHeaders copies HTTP headers from src to dst
 func CopyHeaders(dst, src http.Header) {
@@ -22,3 +38,27 @@ func GetClientIP(r *http.Request) string {
 	}
 	return ip
 }
+
+// RemoveHopHeaders deletes hop-by-hop headers from h, including any listed
+// in its Connection header. "Te: trailers" is kept, as gRPC depends on it.
+func RemoveHopHeaders(h http.Header) {
+	for _, f := range h.Values("Connection") {
+		for _, name := range strings.Split(f, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	trailers := false
+	for _, v := range h.Values("Te") {
+		if strings.EqualFold(strings.TrimSpace(v), "trailers") {
+			trailers = true
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+}
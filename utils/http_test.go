@@ -50,3 +50,26 @@ func TestGetClientIP(t *testing.T) {
 		t.Errorf("expected IP to be '127.0.0.1:8080', got '%s'", ip)
 	}
 }
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "close, X-Hop")
+	h.Set("X-Hop", "1")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("Te", "trailers")
+	h.Set(CUSTOM_HEADER, "custom-value")
+
+	RemoveHopHeaders(h)
+
+	for _, name := range []string{"Connection", "X-Hop", "Keep-Alive"} {
+		if h.Get(name) != "" {
+			t.Errorf("expected %s to be removed, got '%s'", name, h.Get(name))
+		}
+	}
+	if h.Get("Te") != "trailers" {
+		t.Errorf("expected Te to be 'trailers', got '%s'", h.Get("Te"))
+	}
+	if h.Get(CUSTOM_HEADER) != "custom-value" {
+		t.Errorf("expected X-Custom-Header to be kept, got '%s'", h.Get(CUSTOM_HEADER))
+	}
+}